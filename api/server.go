@@ -0,0 +1,180 @@
+// Package api exposes the pipeline query layer over HTTP as JSON
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/notLeoHirano/mbta-etl/pipeline"
+)
+
+// Server serves read-only JSON endpoints backed by an ETLPipeline. Queries
+// run with the request's context, so they stop when the client goes away.
+type Server struct {
+	p   *pipeline.ETLPipeline
+	mux *http.ServeMux
+}
+
+func NewServer(p *pipeline.ETLPipeline) *Server {
+	s := &Server{p: p, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("GET /vehicles", s.handleVehicles)
+	s.mux.HandleFunc("GET /vehicles/{id}", s.handleVehicle)
+	s.mux.HandleFunc("GET /vehicles/{id}/history", s.handleVehicleHistory)
+	s.mux.HandleFunc("GET /geojson", s.handleGeoJSON)
+	s.mux.HandleFunc("GET /stats", s.handleStats)
+	s.mux.HandleFunc("GET /routes", s.handleRoutes)
+	s.mux.HandleFunc("GET /routes/types", s.handleRouteTypes)
+	s.mux.HandleFunc("GET /bearing", s.handleBearing)
+	s.mux.HandleFunc("GET /bearing/summary", s.handleBearingSummary)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleVehicles serves /vehicles?route=Red&status=STOPPED_AT&bbox=minLon,minLat,maxLon,maxLat
+func (s *Server) handleVehicles(w http.ResponseWriter, r *http.Request) {
+	filter, err := vehicleFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	vehicles, err := s.p.FilterVehiclesContext(r.Context(), filter)
+	respond(w, nonNil(vehicles), err)
+}
+
+// handleGeoJSON serves the same filters as /vehicles as a FeatureCollection
+func (s *Server) handleGeoJSON(w http.ResponseWriter, r *http.Request) {
+	filter, err := vehicleFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fc, err := s.p.GetGeoJSONContext(r.Context(), filter)
+	if err != nil {
+		respond(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	if err := json.NewEncoder(w).Encode(fc); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+func (s *Server) handleVehicle(w http.ResponseWriter, r *http.Request) {
+	vehicle, err := s.p.GetVehicleContext(r.Context(), r.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "vehicle not found")
+		return
+	}
+	respond(w, vehicle, err)
+}
+
+func (s *Server) handleVehicleHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := s.p.GetVehicleHistoryContext(r.Context(), r.PathValue("id"))
+	respond(w, nonNil(history), err)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.p.GetSummaryStatsContext(r.Context())
+	respond(w, stats, err)
+}
+
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, err := s.p.GetRouteBreakdownContext(r.Context())
+	respond(w, nonNil(routes), err)
+}
+
+func (s *Server) handleRouteTypes(w http.ResponseWriter, r *http.Request) {
+	routeTypes, err := s.p.GetRouteTypeBreakdownContext(r.Context())
+	respond(w, nonNil(routeTypes), err)
+}
+
+// handleBearing serves /bearing?target=90&delta=15
+func (s *Server) handleBearing(w http.ResponseWriter, r *http.Request) {
+	target, err := floatParam(r, "target", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid target: "+err.Error())
+		return
+	}
+	delta, err := floatParam(r, "delta", 10)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid delta: "+err.Error())
+		return
+	}
+
+	vehicles, err := s.p.GetVehiclesByBearingContext(r.Context(), target, delta)
+	respond(w, nonNil(vehicles), err)
+}
+
+func (s *Server) handleBearingSummary(w http.ResponseWriter, r *http.Request) {
+	summary, err := s.p.GetBearingSummaryContext(r.Context())
+	respond(w, nonNil(summary), err)
+}
+
+// vehicleFilter reads the route, status and bbox query parameters
+func vehicleFilter(r *http.Request) (pipeline.VehicleFilter, error) {
+	q := r.URL.Query()
+	filter := pipeline.VehicleFilter{
+		RouteID: q.Get("route"),
+		Status:  q.Get("status"),
+	}
+
+	if raw := q.Get("bbox"); raw != "" {
+		bbox, err := pipeline.ParseBoundingBox(raw)
+		if err != nil {
+			return filter, err
+		}
+		filter.BBox = bbox
+	}
+
+	return filter, nil
+}
+
+// floatParam reads an optional float query parameter
+func floatParam(r *http.Request, name string, def float64) (float64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+// respond writes v as JSON, or a 500 if the query failed
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		log.Printf("API query failed: %v", err)
+		writeError(w, http.StatusInternalServerError, "query failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// nonNil turns empty results into [] instead of null
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
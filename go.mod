@@ -2,7 +2,11 @@ module github.com/notLeoHirano/mbta-etl
 
 go 1.25.3
 
-require modernc.org/sqlite v1.39.1
+require (
+	github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs v1.0.0
+	google.golang.org/protobuf v1.33.0
+	modernc.org/sqlite v1.39.1
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
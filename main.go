@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/notLeoHirano/mbta-etl/api"
+	"github.com/notLeoHirano/mbta-etl/output"
 	"github.com/notLeoHirano/mbta-etl/pipeline"
 	_ "modernc.org/sqlite"
 )
@@ -13,52 +21,266 @@ import (
 func main() {
 	// CLI flags
 	runETL := flag.Bool("run", false, "Run the ETL pipeline")
-	query := flag.String("query", "", "Query to run (top10, stats, routes, bearing, bearing_summary)")
+	watch := flag.Bool("watch", false, "Run the ETL pipeline continuously until interrupted")
+	interval := flag.Duration("interval", 15*time.Second, "Polling interval for -watch")
+	stream := flag.Bool("stream", false, "Ingest the MBTA vehicles event stream until interrupted")
+	query := flag.String("query", "", "Query to run (top10, stats, routes, route_types, bearing, bearing_summary, geojson, runs)")
+	serve := flag.String("serve", "", "Serve the query API over HTTP on this address (e.g. :8080)")
+	format := flag.String("format", "table", "Query output format (table, json, csv, ndjson)")
 	dbPath := flag.String("db", "mbta_vehicles.db", "Database path")
 	apiURL := flag.String("api", "https://api-v3.mbta.com/vehicles", "MBTA API URL") // default, but can be customized in CLI
+	source := flag.String("source", string(pipeline.SourceJSONAPI), "Vehicle feed format at -api (jsonapi, gtfsrt)")
+	filter := flag.String("filter", "", "API filters as key=value pairs, e.g. route=Red,direction_id=0")
+	fields := flag.String("fields", "", "Comma-separated vehicle fields to request (JSON:API sparse fieldset, always including the stored ones)")
+	include := flag.String("include", "", "Comma-separated related resources to include, e.g. trip,route")
+	pageLimit := flag.Int("page-limit", 0, "Vehicles per API page; pages are followed until exhausted")
+	apiKey := flag.String("api-key", "", "MBTA API key (defaults to $MBTA_API_KEY)")
+	timeout := flag.Duration("timeout", pipeline.DefaultTimeout, "Timeout for each MBTA API request")
+	userAgent := flag.String("user-agent", pipeline.DefaultUserAgent, "User-Agent header for MBTA API requests")
+	retries := flag.Int("retries", pipeline.DefaultRetryPolicy.MaxRetries, "Retries for transient MBTA API failures (5xx, timeouts, 429)")
+	archive := flag.String("archive", "", "Directory to save raw API responses in (gzipped, timestamped)")
+	replay := flag.String("replay", "", "Load archived responses from this file or directory instead of the API")
+	validate := flag.Bool("validate", true, "Quarantine vehicles failing data quality rules in rejected_records")
+	serviceArea := flag.String("service-area", "", "Bounding box vehicles must be inside, minLon,minLat,maxLon,maxLat (defaults to the MBTA service area)")
+	maxAge := flag.Duration("max-age", pipeline.DefaultValidationRules.MaxAge, "Reject vehicles whose updated_at is older than this (0 disables; ignored by -replay)")
+	staleAfter := flag.Duration("stale-after", 0, "Retire vehicles not updated for this long, as well as ones missing from a run (0 disables)")
+	deleteStale := flag.Bool("delete-stale", false, "Delete vehicles that leave service instead of marking them stale")
+	includeStale := flag.Bool("include-stale", false, "Include stale vehicles in query results")
+	syncRoutes := flag.Bool("sync-routes", false, "Fetch route metadata from the MBTA API")
+	migrate := flag.String("migrate", "", "Manage the database schema (status, up, down)")
+	importGTFS := flag.String("import-gtfs", "", "Import a static GTFS feed zip (routes, stops, trips, stop times, shapes, calendars)")
+	routesURL := flag.String("routes-api", pipeline.DefaultRoutesURL, "MBTA routes API URL")
 	bearing := flag.Float64("bearing", 0, "Target bearing for filtering vehicles")
 	delta := flag.Float64("delta", 10, "Degree range around bearing for filtering vehicles")
+	route := flag.String("route", "", "Only include vehicles on this route id (geojson)")
+	status := flag.String("status", "", "Only include vehicles with this current status (geojson)")
+	limit := flag.Int("limit", 20, "Number of recent runs to list (runs)")
+	bbox := flag.String("bbox", "", "Only include vehicles inside minLon,minLat,maxLon,maxLat (geojson)")
 
 	flag.Parse()
 
-	pipeline, err := pipeline.NewETLPipeline(*apiURL, *dbPath)
+	// Read the key after parsing so it never shows up in the usage text
+	if *apiKey == "" {
+		*apiKey = os.Getenv("MBTA_API_KEY")
+	}
+
+	outFormat, err := output.ParseFormat(*format)
+	if err != nil {
+		log.Fatalf("Invalid -format: %v", err)
+	}
+
+	feedSource, err := pipeline.ParseSource(*source)
+	if err != nil {
+		log.Fatalf("Invalid -source: %v", err)
+	}
+	// The GTFS-RT feed lives at a different URL unless -api overrides it
+	vehiclesURL := *apiURL
+	if feedSource == pipeline.SourceGTFSRT && !flagSet("api") {
+		vehiclesURL = pipeline.DefaultGTFSRTURL
+	}
+
+	filters, err := parseKeyValues(*filter)
+	if err != nil {
+		log.Fatalf("Invalid -filter: %v", err)
+	}
+	extractOpts := pipeline.ExtractOptions{
+		Filter:    filters,
+		Include:   splitList(*include),
+		PageLimit: *pageLimit,
+	}
+	if vehicleFields := splitList(*fields); len(vehicleFields) > 0 {
+		extractOpts.Fields = map[string][]string{"vehicle": vehicleFields}
+	}
+
+	retryPolicy := pipeline.DefaultRetryPolicy
+	retryPolicy.MaxRetries = *retries
+
+	opts := []pipeline.Option{
+		pipeline.WithSource(feedSource),
+		pipeline.WithRoutesURL(*routesURL),
+		pipeline.WithExtractOptions(extractOpts),
+		pipeline.WithRetryPolicy(retryPolicy),
+		pipeline.WithAPIKey(*apiKey),
+		pipeline.WithTimeout(*timeout),
+		pipeline.WithUserAgent(*userAgent),
+		pipeline.WithArchiveDir(*archive),
+		pipeline.WithStalePolicy(pipeline.StalePolicy{Absent: true, MaxAge: *staleAfter, Delete: *deleteStale}),
+		pipeline.WithIncludeStale(*includeStale),
+		// -migrate inspects or rolls back the schema, so it must not upgrade it first
+		pipeline.WithAutoMigrate(*migrate == ""),
+	}
+	if *validate {
+		rules := pipeline.DefaultValidationRules
+		rules.MaxAge = *maxAge
+		// Archived responses are old by definition
+		if *replay != "" {
+			rules.MaxAge = 0
+		}
+		if *serviceArea != "" {
+			if rules.ServiceArea, err = pipeline.ParseBoundingBox(*serviceArea); err != nil {
+				log.Fatalf("Invalid -service-area: %v", err)
+			}
+		}
+		opts = append(opts, pipeline.WithValidation(rules))
+	}
+
+	etl, err := pipeline.NewETLPipeline(vehiclesURL, *dbPath, opts...)
 	if err != nil {
 		log.Fatalf("Failed to initialize pipeline: %v", err)
 	}
-	defer pipeline.Close()
+	defer etl.Close()
+
+	// SIGINT/SIGTERM cancel the running command; an uncommitted load is rolled back
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *serve != "" {
+		srv := &http.Server{
+			Addr:              *serve,
+			Handler:           api.NewServer(etl),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+
+		log.Printf("Serving API on %s (Ctrl+C to stop)", *serve)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("API server failed: %v", err)
+		}
+		return
+	}
+
+	if *migrate != "" {
+		runMigrate(ctx, etl, *migrate, outFormat)
+		return
+	}
+
+	if *syncRoutes {
+		if _, err := etl.SyncRoutesContext(ctx); err != nil {
+			log.Fatalf("Route sync failed: %v", err)
+		}
+		fmt.Println("\nRoute sync completed successfully")
+		return
+	}
+
+	if *importGTFS != "" {
+		if _, err := etl.ImportGTFSContext(ctx, *importGTFS); err != nil {
+			log.Fatalf("GTFS import failed: %v", err)
+		}
+		fmt.Println("\nGTFS import completed successfully")
+		return
+	}
+
+	if *replay != "" {
+		if _, err := etl.ReplayContext(ctx, *replay); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		fmt.Println("\nReplay completed successfully")
+		return
+	}
+
+	if *watch {
+		// Watch rolls back the cycle in progress unless its data is all loaded
+		log.Printf("Watching MBTA API every %v (Ctrl+C to stop)", *interval)
+		if err := etl.Watch(ctx, *interval); err != nil {
+			log.Fatalf("ETL watch failed: %v", err)
+		}
+		return
+	}
+
+	if *stream {
+		log.Println("Streaming MBTA vehicle events (Ctrl+C to stop)")
+		if err := etl.Stream(ctx); err != nil {
+			log.Fatalf("ETL stream failed: %v", err)
+		}
+		return
+	}
 
 	if *runETL {
-		if err := pipeline.Run(); err != nil {
+		if _, err := etl.RunContext(ctx); err != nil {
 			log.Fatalf("ETL pipeline failed: %v", err)
 		}
 		fmt.Println("\nETL pipeline completed successfully")
-		
+
 		fmt.Println("\nUsage:")
 		fmt.Println("  Run ETL:             go run main.go -run")
+		fmt.Println("  Run filtered ETL:    go run main.go -run -filter route=Red -page-limit 100")
+		fmt.Println("  Watch continuously:  go run main.go -watch -interval 15s")
+		fmt.Println("  Stream live events:  go run main.go -stream")
+		fmt.Println("  Run from GTFS-RT:    go run main.go -run -source gtfsrt")
+		fmt.Println("  Archive responses:   go run main.go -watch -archive ./archive")
+		fmt.Println("  Replay archive:      go run main.go -replay ./archive")
 		fmt.Println("  Query top 10:        go run main.go -query top10")
 		fmt.Println("  Query stats:         go run main.go -query stats")
+		fmt.Println("  Include departed:    go run main.go -query top10 -include-stale")
+		fmt.Println("  Sync routes:         go run main.go -sync-routes")
+		fmt.Println("  Import GTFS:         go run main.go -import-gtfs MBTA_GTFS.zip")
 		fmt.Println("  Query routes:        go run main.go -query routes")
+		fmt.Println("  Query route types:   go run main.go -query route_types")
+		fmt.Println("  Export GeoJSON:      go run main.go -query geojson -route Red > vehicles.geojson")
+		fmt.Println("  Output as JSON:      go run main.go -query stats -format json")
+		fmt.Println("  Serve HTTP API:      go run main.go -serve :8080")
 		fmt.Println("  Query by bearing:    go run main.go -query bearing -bearing 90 -delta 15")
 		fmt.Println("  Get bearing summary: go run main.go -query bearing_summary")
-			
+		fmt.Println("  List recent runs:    go run main.go -query runs -limit 50")
+		fmt.Println("  Migration status:    go run main.go -migrate status")
+
 		return
 	}
 
 	switch *query {
 	case "top10":
-		vehicles, err := pipeline.GetTop10FastestVehicles()
+		vehicles, err := etl.GetTop10FastestVehicles()
 		if err != nil {
 			log.Fatalf("Query failed: %v", err)
 		}
+		if outFormat != output.Table {
+			writeOutput(outFormat, vehicles)
+			break
+		}
 
 		fmt.Println("\nTop 10 Fastest Vehicles")
 		for i, v := range vehicles {
-			fmt.Printf("%d. Vehicle %s (Label: %s) - Speed: %.2f mph, Status: %s\n",
-				i+1, v.ID, v.Label, v.Speed, v.CurrentStatus)
+			fmt.Printf("%d. Vehicle %s (Label: %s) - Speed: %s m/s, Status: %s\n",
+				i+1, v.ID, v.Label, formatOptional("%.2f", v.Speed), v.CurrentStatus)
+		}
+
+	case "route_types":
+		routeTypes, err := etl.GetRouteTypeBreakdown()
+		if err != nil {
+			log.Fatalf("Query failed: %v", err)
 		}
+		if outFormat != output.Table {
+			writeOutput(outFormat, routeTypes)
+			break
+		}
+
+		fmt.Println("\nMBTA ROUTE TYPE BREAKDOWN")
+		fmt.Println()
+		fmt.Printf("%-20s %10s %15s %15s\n", "Route Type", "Count", "Avg Speed", "Max Speed")
+		fmt.Println("─────────────────────────────────────────────────────────────")
+
+		for _, rt := range routeTypes {
+			fmt.Printf("%-20s %10d %12.2f m/s %12.2f m/s\n",
+				rt.Name, rt.Count, rt.AvgSpeed, rt.MaxSpeed)
+		}
+		fmt.Println()
 
 	case "routes":
-		routes, err := pipeline.GetRouteBreakdown()
+		routes, err := etl.GetRouteBreakdown()
+		if err != nil {
+			log.Fatalf("Query failed: %v", err)
+		}
+		// Machine formats carry the route type on every route row
+		if outFormat != output.Table {
+			writeOutput(outFormat, routes)
+			break
+		}
+		routeTypes, err := etl.GetRouteTypeBreakdown()
 		if err != nil {
 			log.Fatalf("Query failed: %v", err)
 		}
@@ -68,85 +290,279 @@ func main() {
 		fmt.Printf("%-20s %10s %15s %15s\n", "Route Type", "Count", "Avg Speed", "Max Speed")
 		fmt.Println("─────────────────────────────────────────────────────────────")
 
+		for _, rt := range routeTypes {
+			fmt.Printf("%-20s %10d %12.2f m/s %12.2f m/s\n",
+				rt.Name, rt.Count, rt.AvgSpeed, rt.MaxSpeed)
+		}
+		fmt.Println()
+
+		fmt.Printf("%-12s %-30s %10s %15s %15s\n", "Route", "Name", "Count", "Avg Speed", "Max Speed")
+		fmt.Println("───────────────────────────────────────────────────────────────────────────────────────")
+
 		for _, route := range routes {
-			fmt.Printf("%-20s %10v %12s mph %12s mph\n",
-				route["route_type"], route["count"], route["avg_speed"], route["max_speed"])
+			routeID := route.RouteID
+			if routeID == "" {
+				routeID = "(none)"
+			}
+			fmt.Printf("%-12s %-30s %10d %12.2f m/s %12.2f m/s\n",
+				routeID, route.LongName, route.Count, route.AvgSpeed, route.MaxSpeed)
 		}
 		fmt.Println()
 
 	case "stats":
-		stats, err := pipeline.GetSummaryStats()
+		stats, err := etl.GetSummaryStats()
 		if err != nil {
 			log.Fatalf("Query failed: %v", err)
 		}
+		if outFormat != output.Table {
+			writeOutput(outFormat, stats)
+			break
+		}
 
 		fmt.Println("\nMBTA VEHICLE SUMMARY STATISTICS")
 
 		fmt.Println("\nFLEET OVERVIEW")
-		fmt.Printf("   Total Vehicles: %v\n", stats["total_vehicles"])
-		fmt.Printf("   Moving: %v (%v)\n", stats["moving_vehicles"], stats["percent_moving"])
-		fmt.Printf("   Stationary: %v\n", stats["stationary_vehicles"])
+		fmt.Printf("   Total Vehicles: %d\n", stats.TotalVehicles)
+		fmt.Printf("   Moving: %d (%.1f%%)\n", stats.MovingVehicles, stats.PercentMoving)
+		fmt.Printf("   Stationary: %d\n", stats.StationaryVehicles)
+		fmt.Printf("   No Speed Reported: %d\n", stats.MissingSpeed)
+		fmt.Printf("   No Bearing Reported: %d\n", stats.MissingBearing)
 
 		fmt.Println("\nSPEED METRICS")
-		fmt.Printf("   Average Speed: %v\n", stats["average_speed"])
-		fmt.Printf("   Median Speed: %v\n", stats["median_speed"])
-		fmt.Printf("   Max Speed: %v\n", stats["max_speed"])
-		fmt.Printf("   90th Percentile: %v\n", stats["speed_90th_percentile"])
-		fmt.Printf("   95th Percentile: %v\n", stats["speed_95th_percentile"])
+		fmt.Printf("   Average Speed: %.2f m/s\n", stats.AverageSpeed)
+		fmt.Printf("   Median Speed: %.2f m/s\n", stats.MedianSpeed)
+		fmt.Printf("   Max Speed: %.2f m/s\n", stats.MaxSpeed)
+		fmt.Printf("   90th Percentile: %.2f m/s\n", stats.Speed90thPercentile)
+		fmt.Printf("   95th Percentile: %.2f m/s\n", stats.Speed95thPercentile)
 
 		fmt.Println("\nVEHICLE STATUS")
-		fmt.Printf("   In Transit: %v\n", stats["in_transit"])
-		fmt.Printf("   Stopped: %v\n", stats["stopped"])
-		fmt.Printf("   Incoming: %v\n", stats["incoming"])
+		fmt.Printf("   In Transit: %d\n", stats.InTransit)
+		fmt.Printf("   Stopped: %d\n", stats.Stopped)
+		fmt.Printf("   Incoming: %d\n", stats.Incoming)
 
 		fmt.Println("\nOCCUPANCY LEVELS")
-		fmt.Printf("   Many Seats Available: %v\n", stats["occupancy_many_seats"])
-		fmt.Printf("   Few Seats Available: %v\n", stats["occupancy_few_seats"])
-		fmt.Printf("   Unknown: %v\n", stats["occupancy_unknown"])
+		fmt.Printf("   Many Seats Available: %.1f%%\n", stats.OccupancyManySeats)
+		fmt.Printf("   Few Seats Available: %.1f%%\n", stats.OccupancyFewSeats)
+		fmt.Printf("   Unknown: %.1f%%\n", stats.OccupancyUnknown)
 
 		fmt.Println("\nDIRECTION")
-		fmt.Printf("   Outbound (Direction 0): %v\n", stats["outbound_vehicles"])
-		fmt.Printf("   Inbound (Direction 1): %v\n", stats["inbound_vehicles"])
+		fmt.Printf("   Outbound (Direction 0): %d\n", stats.OutboundVehicles)
+		fmt.Printf("   Inbound (Direction 1): %d\n", stats.InboundVehicles)
 		fmt.Println()
 
 	case "bearing":
-		vehicles, err := pipeline.GetVehiclesByBearing(*bearing, *delta)
+		vehicles, err := etl.GetVehiclesByBearing(*bearing, *delta)
 		if err != nil {
 			log.Fatalf("Query failed: %v", err)
 		}
+		if outFormat != output.Table {
+			writeOutput(outFormat, vehicles)
+			break
+		}
 
 		fmt.Printf("\nVehicles with Bearing %.1f ± %.1f degrees\n", *bearing, *delta)
 		fmt.Println()
 		fmt.Printf("%-10s %-10s %-10s %-10s\n", "Vehicle ID", "Label", "Bearing", "Speed")
 		fmt.Println("─────────────────────────────────────────────")
 		for _, v := range vehicles {
-			fmt.Printf("%-10s %-10s %-10d %-10.2f\n", v.ID, v.Label, v.Bearing, v.Speed)
+			fmt.Printf("%-10s %-10s %-10s %-10s\n", v.ID, v.Label, formatOptional("%d", v.Bearing), formatOptional("%.2f", v.Speed))
 		}
 		fmt.Println()
 
 	case "bearing_summary":
-		summary, err := pipeline.GetBearingSummary()
+		summary, err := etl.GetBearingSummary()
 		if err != nil {
 			log.Fatalf("Query failed: %v", err)
 		}
+		if outFormat != output.Table {
+			writeOutput(outFormat, summary)
+			break
+		}
 
 		fmt.Println("\nVehicle Bearing Summary")
 		fmt.Println()
 		fmt.Printf("%-15s %10s\n", "Direction", "Count")
 		fmt.Println("───────────────────────────")
-		for dir, count := range summary {
-			fmt.Printf("%-15s %10d\n", dir, count)
+		for _, bucket := range summary {
+			fmt.Printf("%-15s %10d\n", bucket.Direction, bucket.Count)
+		}
+		fmt.Println()
+
+	case "geojson":
+		filter := pipeline.VehicleFilter{RouteID: *route, Status: *status}
+		if *bbox != "" {
+			box, err := pipeline.ParseBoundingBox(*bbox)
+			if err != nil {
+				log.Fatalf("Invalid -bbox: %v", err)
+			}
+			filter.BBox = box
+		}
+
+		fc, err := etl.GetGeoJSON(filter)
+		if err != nil {
+			log.Fatalf("Query failed: %v", err)
+		}
+		// GeoJSON is always JSON regardless of -format
+		writeOutput(output.JSON, fc)
+
+	case "runs":
+		runs, err := etl.GetRecentRuns(*limit)
+		if err != nil {
+			log.Fatalf("Query failed: %v", err)
+		}
+		if outFormat != output.Table {
+			writeOutput(outFormat, runs)
+			break
+		}
+
+		fmt.Println("\nRecent Ingestion Runs")
+		fmt.Println()
+		fmt.Printf("%-6s %-20s %10s %10s %10s %8s %9s %8s %6s  %s\n",
+			"Run", "Started (UTC)", "Duration", "Extracted", "Loaded", "Skipped", "Rejected", "Status", "HTTP", "Error")
+		fmt.Println("────────────────────────────────────────────────────────────────────────────────────────────────────────")
+		for _, run := range runs {
+			status := "ok"
+			switch {
+			case run.FinishedAt == nil:
+				status = "running"
+			case run.Error != "":
+				status = "failed"
+			case run.NotModified:
+				status = "no-op"
+			}
+			fmt.Printf("%-6d %-20s %8dms %10d %10d %8d %9d %8s %6d  %s\n",
+				run.ID, run.StartedAt.UTC().Format("2006-01-02 15:04:05"), run.DurationMS,
+				run.Extracted, run.Loaded, run.Skipped, run.Rejected, status, run.HTTPStatus, run.Error)
 		}
 		fmt.Println()
 
 	default:
 		fmt.Println("Usage:")
 		fmt.Println("  Run ETL:             go run main.go -run")
+		fmt.Println("  Run filtered ETL:    go run main.go -run -filter route=Red -page-limit 100")
+		fmt.Println("  Watch continuously:  go run main.go -watch -interval 15s")
+		fmt.Println("  Stream live events:  go run main.go -stream")
+		fmt.Println("  Run from GTFS-RT:    go run main.go -run -source gtfsrt")
+		fmt.Println("  Archive responses:   go run main.go -watch -archive ./archive")
+		fmt.Println("  Replay archive:      go run main.go -replay ./archive")
 		fmt.Println("  Query top 10:        go run main.go -query top10")
 		fmt.Println("  Query stats:         go run main.go -query stats")
+		fmt.Println("  Include departed:    go run main.go -query top10 -include-stale")
+		fmt.Println("  Sync routes:         go run main.go -sync-routes")
+		fmt.Println("  Import GTFS:         go run main.go -import-gtfs MBTA_GTFS.zip")
 		fmt.Println("  Query routes:        go run main.go -query routes")
+		fmt.Println("  Query route types:   go run main.go -query route_types")
+		fmt.Println("  Export GeoJSON:      go run main.go -query geojson -route Red > vehicles.geojson")
+		fmt.Println("  Output as JSON:      go run main.go -query stats -format json")
+		fmt.Println("  Serve HTTP API:      go run main.go -serve :8080")
 		fmt.Println("  Query by bearing:    go run main.go -query bearing -bearing 90 -delta 15")
 		fmt.Println("  Get bearing summary: go run main.go -query bearing_summary")
+		fmt.Println("  List recent runs:    go run main.go -query runs -limit 50")
+		fmt.Println("  Migration status:    go run main.go -migrate status")
 		os.Exit(1)
 	}
 }
+
+// runMigrate handles -migrate status|up|down
+func runMigrate(ctx context.Context, etl *pipeline.ETLPipeline, command string, format output.Format) {
+	switch command {
+	case "up":
+		count, err := etl.MigrateUpContext(ctx)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		fmt.Printf("\nApplied %d migration(s)\n", count)
+
+	case "down":
+		version, err := etl.MigrateDownContext(ctx)
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		if version == 0 {
+			fmt.Println("\nNo migrations to revert")
+			return
+		}
+		fmt.Printf("\nReverted migration %d\n", version)
+
+	case "status":
+		statuses, err := etl.MigrationsContext(ctx)
+		if err != nil {
+			log.Fatalf("Migration status failed: %v", err)
+		}
+		if format != output.Table {
+			writeOutput(format, statuses)
+			return
+		}
+
+		fmt.Println("\nSchema Migrations")
+		fmt.Println()
+		fmt.Printf("%-8s %-32s %s\n", "Version", "Name", "Applied (UTC)")
+		fmt.Println("────────────────────────────────────────────────────────────────")
+		for _, m := range statuses {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-8d %-32s %s\n", m.Version, m.Name, applied)
+		}
+		fmt.Println()
+
+	default:
+		log.Fatalf("Invalid -migrate: %q (want status, up or down)", command)
+	}
+}
+
+// writeOutput prints query results in a machine-readable format
+func writeOutput(format output.Format, v interface{}) {
+	if err := output.Write(os.Stdout, format, v); err != nil {
+		log.Fatalf("Failed to write output: %v", err)
+	}
+}
+
+// formatOptional formats a nullable reading, or "unknown" if it is missing
+func formatOptional[T any](format string, v *T) string {
+	if v == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf(format, *v)
+}
+
+// parseKeyValues parses "key=value,key=value" as used by -filter
+func parseKeyValues(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	if s == "" {
+		return result, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		result[key] = strings.TrimSpace(value)
+	}
+	return result, nil
+}
+
+// flagSet reports whether the named flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
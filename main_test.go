@@ -1,14 +1,29 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/notLeoHirano/mbta-etl/api"
+	"github.com/notLeoHirano/mbta-etl/output"
 	"github.com/notLeoHirano/mbta-etl/pipeline"
 
 	. "github.com/notLeoHirano/mbta-etl/model"
@@ -75,7 +90,8 @@ func TestExtractAPIError(t *testing.T) {
 	}))
 	defer server.Close()
 
-	p, err := pipeline.NewETLPipeline(server.URL, ":memory:")
+	// No retries, so the 500 fails at once instead of backing off
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:", pipeline.WithRetryPolicy(pipeline.RetryPolicy{}))
 	if err != nil {
 		t.Fatalf("Failed to create p: %v", err)
 	}
@@ -143,13 +159,13 @@ func TestTransformNullableFields(t *testing.T) {
 		t.Fatalf("Expected 1 record, got %d", len(records))
 	}
 
-	// Check defaults for nullable fields
-	if records[0].Speed != 0.0 {
-		t.Errorf("Expected speed 0.0 for nil, got %.2f", records[0].Speed)
+	// Missing readings stay unknown rather than becoming 0
+	if records[0].Speed != nil {
+		t.Errorf("Expected nil speed for nil, got %.2f", *records[0].Speed)
 	}
 
-	if records[0].Bearing != 0 {
-		t.Errorf("Expected bearing 0 for nil, got %d", records[0].Bearing)
+	if records[0].Bearing != nil {
+		t.Errorf("Expected nil bearing for nil, got %d", *records[0].Bearing)
 	}
 }
 
@@ -220,7 +236,7 @@ func TestTransformNormalizesStatus(t *testing.T) {
 				Label:           "1234",
 				Latitude:        42.3601,
 				Longitude:       -71.0589,
-				CurrentStatus:   "",                 // Empty status
+				CurrentStatus:   "",                     // Empty status
 				OccupancyStatus: "MANY_SEATS_AVAILABLE", // Normal status
 			},
 		},
@@ -268,11 +284,11 @@ func TestLoadSuccess(t *testing.T) {
 			Label:           "1234",
 			Latitude:        42.3601,
 			Longitude:       -71.0589,
-			Speed:           25.5,
+			Speed:           ptr(25.5),
 			DirectionID:     0,
 			CurrentStatus:   "IN_TRANSIT_TO",
 			OccupancyStatus: "MANY_SEATS_AVAILABLE",
-			Bearing:         180,
+			Bearing:         ptr(180),
 			UpdatedAt:       time.Now(),
 			IngestedAt:      time.Now(),
 		},
@@ -284,7 +300,7 @@ func TestLoadSuccess(t *testing.T) {
 	}
 
 	// Verify data was stored
-  count, err := p.CountVehicles()
+	count, err := p.CountVehicles()
 
 	if err != nil {
 		t.Fatalf("Failed to query database: %v", err)
@@ -315,11 +331,11 @@ func TestLoadHandlesDuplicates(t *testing.T) {
 		Label:           "1234",
 		Latitude:        42.3601,
 		Longitude:       -71.0589,
-		Speed:           25.5,
+		Speed:           ptr(25.5),
 		DirectionID:     0,
 		CurrentStatus:   "IN_TRANSIT_TO",
 		OccupancyStatus: "MANY_SEATS_AVAILABLE",
-		Bearing:         180,
+		Bearing:         ptr(180),
 		UpdatedAt:       time.Now(),
 		IngestedAt:      time.Now(),
 	}
@@ -331,7 +347,7 @@ func TestLoadHandlesDuplicates(t *testing.T) {
 	}
 
 	// Load again with updated speed
-	record.Speed = 30.0
+	record.Speed = ptr(30.0)
 	err = p.Load([]VehicleRecord{record})
 	if err != nil {
 		t.Fatalf("Second load failed: %v", err)
@@ -353,8 +369,8 @@ func TestLoadHandlesDuplicates(t *testing.T) {
 		t.Fatalf("Failed to query speed: %v", err)
 	}
 
-	if speed != 30.0 {
-		t.Errorf("Expected updated speed 30.0, got %.2f", speed)
+	if speed == nil || *speed != 30.0 {
+		t.Errorf("Expected updated speed 30.0, got %s", formatOptional("%.2f", speed))
 	}
 }
 
@@ -381,11 +397,11 @@ func TestGetTop10FastestVehicles(t *testing.T) {
 			Label:           string(rune('1' + i)),
 			Latitude:        42.3601,
 			Longitude:       -71.0589,
-			Speed:           float64(i * 5), // 0, 5, 10, 15, ... 70
+			Speed:           ptr(float64(i * 5)), // 0, 5, 10, 15, ... 70
 			DirectionID:     0,
 			CurrentStatus:   "IN_TRANSIT_TO",
 			OccupancyStatus: "MANY_SEATS_AVAILABLE",
-			Bearing:         180,
+			Bearing:         ptr(180),
 			UpdatedAt:       time.Now(),
 			IngestedAt:      time.Now(),
 		})
@@ -408,15 +424,15 @@ func TestGetTop10FastestVehicles(t *testing.T) {
 
 	// Verify they are sorted by speed (descending)
 	for i := 0; i < len(top10)-1; i++ {
-		if top10[i].Speed < top10[i+1].Speed {
+		if *top10[i].Speed < *top10[i+1].Speed {
 			t.Errorf("Results not sorted: vehicle %d (speed %.2f) < vehicle %d (speed %.2f)",
-				i, top10[i].Speed, i+1, top10[i+1].Speed)
+				i, *top10[i].Speed, i+1, *top10[i+1].Speed)
 		}
 	}
 
-	// Fastest should be 70 mph
-	if top10[0].Speed != 70.0 {
-		t.Errorf("Expected fastest vehicle at 70 mph, got %.2f", top10[0].Speed)
+	// Fastest should be 70 m/s
+	if *top10[0].Speed != 70.0 {
+		t.Errorf("Expected fastest vehicle at 70 m/s, got %.2f", *top10[0].Speed)
 	}
 }
 
@@ -439,20 +455,20 @@ func TestGetSummaryStats(t *testing.T) {
 	records := []VehicleRecord{
 		{
 			ID: "1", Label: "A", Latitude: 42.3601, Longitude: -71.0589,
-			Speed: 10.0, DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
-			OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: 180,
+			Speed: ptr(10.0), DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
+			OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: ptr(180),
 			UpdatedAt: time.Now(), IngestedAt: time.Now(),
 		},
 		{
 			ID: "2", Label: "B", Latitude: 42.3601, Longitude: -71.0589,
-			Speed: 20.0, DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
-			OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: 180,
+			Speed: ptr(20.0), DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
+			OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: ptr(180),
 			UpdatedAt: time.Now(), IngestedAt: time.Now(),
 		},
 		{
 			ID: "3", Label: "C", Latitude: 42.3601, Longitude: -71.0589,
-			Speed: 30.0, DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
-			OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: 180,
+			Speed: ptr(30.0), DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
+			OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: ptr(180),
 			UpdatedAt: time.Now(), IngestedAt: time.Now(),
 		},
 	}
@@ -467,29 +483,2784 @@ func TestGetSummaryStats(t *testing.T) {
 		t.Fatalf("Query failed: %v", err)
 	}
 
-	avgSpeedStr, ok := stats["average_speed"].(string)
-	if !ok {
-			t.Fatalf("average_speed is not a string")
+	if stats.TotalVehicles != 3 {
+		t.Errorf("Expected 3 vehicles, got %d", stats.TotalVehicles)
+	}
+
+	if stats.AverageSpeed != 20.0 {
+		t.Errorf("Expected average speed 20.0, got %.2f", stats.AverageSpeed)
+	}
+
+	if stats.MaxSpeed != 30.0 {
+		t.Errorf("Expected max speed 30.0, got %.2f", stats.MaxSpeed)
+	}
+
+	if stats.MedianSpeed != 20.0 {
+		t.Errorf("Expected median speed 20.0, got %.2f", stats.MedianSpeed)
+	}
+
+	if stats.PercentMoving != 100.0 {
+		t.Errorf("Expected 100%% moving, got %.1f", stats.PercentMoving)
+	}
+}
+
+// Test Query - Summary statistics on an empty database
+func TestGetSummaryStatsEmpty(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("http://test", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	stats, err := p.GetSummaryStats()
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if stats.TotalVehicles != 0 || stats.AverageSpeed != 0 || stats.PercentMoving != 0 {
+		t.Errorf("Expected zero stats for empty database, got %+v", stats)
+	}
+}
+
+// Test Load - Keeps an append-only position history
+func TestLoadAppendsPositionHistory(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "test*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := pipeline.NewETLPipeline("http://test", tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	first := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	record := VehicleRecord{
+		ID: "y1838", Label: "1838", Latitude: 42.3601, Longitude: -71.0589,
+		Speed: ptr(10.0), DirectionID: 0, CurrentStatus: "IN_TRANSIT_TO",
+		OccupancyStatus: "MANY_SEATS_AVAILABLE", Bearing: ptr(90),
+		UpdatedAt: first, IngestedAt: time.Now(),
+	}
+
+	// Same observation twice should only be recorded once
+	for i := 0; i < 2; i++ {
+		if err := p.Load([]VehicleRecord{record}); err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+	}
+
+	// A newer observation is appended
+	record.UpdatedAt = first.Add(10 * time.Minute)
+	record.Speed = ptr(20.0)
+	if err := p.Load([]VehicleRecord{record}); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// A late, older observation is kept in history but not as latest
+	record.UpdatedAt = first.Add(5 * time.Minute)
+	record.Speed = ptr(15.0)
+	if err := p.Load([]VehicleRecord{record}); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	history, err := p.GetVehicleHistory("y1838")
+	if err != nil {
+		t.Fatalf("Failed to query history: %v", err)
+	}
+
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 positions in history, got %d", len(history))
+	}
+
+	if !history[0].UpdatedAt.Equal(first) {
+		t.Errorf("Expected oldest position at %v, got %v", first, history[0].UpdatedAt)
+	}
+
+	count, err := p.CountVehicles()
+	if err != nil {
+		t.Fatalf("Failed to query database: %v", err)
+	}
+
+	if count != 1 {
+		t.Errorf("Expected 1 latest vehicle, got %d", count)
+	}
+
+	speed, err := p.GetVehicleSpeed("y1838")
+	if err != nil {
+		t.Fatalf("Failed to query speed: %v", err)
+	}
+
+	if speed == nil || *speed != 20.0 {
+		t.Errorf("Expected latest speed 20.0, got %s", formatOptional("%.2f", speed))
+	}
+}
+
+// ptr returns a pointer to v, for the nullable record fields
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// fakeClock lets tests decide when a Watch cycle's wait elapses
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits chan fakeWait
+}
+
+type fakeWait struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waits: make(chan fakeWait, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.waits <- fakeWait{d: d, ch: ch}
+	return ch
+}
+
+// next blocks until the watcher waits, then returns that wait
+func (c *fakeClock) next(t *testing.T) fakeWait {
+	t.Helper()
+	select {
+	case w := <-c.waits:
+		return w
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for watcher to sleep")
+		return fakeWait{}
+	}
+}
+
+// fire advances time by the wait's duration and wakes the watcher
+func (c *fakeClock) fire(w fakeWait) {
+	c.mu.Lock()
+	c.now = c.now.Add(w.d)
+	now := c.now
+	c.mu.Unlock()
+	w.ch <- now
+}
+
+// Test Watch - Polls on every tick and stops on cancellation
+func TestWatchPollsUntilCancelled(t *testing.T) {
+	mockResponse := `{
+		"data": [
+			{
+				"id": "test-vehicle-1",
+				"type": "vehicle",
+				"attributes": {
+					"updated_at": "2024-01-15T10:30:00-05:00",
+					"speed": 25.5,
+					"label": "1234",
+					"latitude": 42.3601,
+					"longitude": -71.0589,
+					"current_status": "IN_TRANSIT_TO",
+					"bearing": 180
+				}
+			}
+		]
+	}`
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mockResponse))
+	}))
+	defer server.Close()
+
+	tmpfile, err := os.CreateTemp("", "test*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	clock := newFakeClock(time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC))
+	p, err := pipeline.NewETLPipeline(server.URL, tmpfile.Name(), pipeline.WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Watch(ctx, 15*time.Second)
+	}()
+
+	// First cycle runs immediately, then waits a full interval
+	wait := clock.next(t)
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("Expected 1 request after first cycle, got %d", got)
+	}
+	if wait.d != 15*time.Second {
+		t.Errorf("Expected wait of 15s, got %v", wait.d)
+	}
+
+	count, err := p.CountVehicles()
+	if err != nil {
+		t.Fatalf("Failed to query database: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 vehicle after first cycle, got %d", count)
+	}
+
+	// Second cycle only runs once the clock ticks
+	clock.fire(wait)
+	clock.next(t)
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("Expected 2 requests after second cycle, got %d", got)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not stop after cancellation")
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("Expected no requests after cancellation, got %d", got)
+	}
+}
+
+// Test Watch - Cancelling aborts a hung extract instead of waiting it out
+func TestWatchCancelsSlowExtract(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Minute):
+		}
+	}))
+	defer server.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL, t.TempDir()+"/etl.db")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Watch(ctx, 15*time.Second)
+	}()
+
+	<-requested
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not abort the extract after cancellation")
+	}
+
+	runs, err := p.GetRecentRuns(1)
+	if err != nil {
+		t.Fatalf("GetRecentRuns failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Error == "" || runs[0].FinishedAt == nil {
+		t.Errorf("Expected the aborted cycle to be recorded as failed, got %+v", runs)
+	}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test Stream - Applies SSE events and reconnects after a drop
+func TestStreamAppliesEventsAndReconnects(t *testing.T) {
+	vehicle := func(id string, speed float64) string {
+		return `{"id":"` + id + `","type":"vehicle","attributes":{` +
+			`"updated_at":"2024-01-15T10:30:00-05:00","label":"` + id + `",` +
+			`"latitude":42.3601,"longitude":-71.0589,"speed":` + strconv.FormatFloat(speed, 'f', 1, 64) + `}}`
+	}
+
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			t.Errorf("Expected Accept: text/event-stream, got %q", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		if atomic.AddInt32(&connections, 1) == 1 {
+			// First connection: full state, an update and a removal, then drop
+			w.Write([]byte("event: reset\ndata: [" + vehicle("v1", 10) + "," + vehicle("v2", 20) + "]\n\n"))
+			w.Write([]byte(": keep-alive\n\n"))
+			w.Write([]byte("event: update\ndata: " + vehicle("v1", 15) + "\n\n"))
+			w.Write([]byte("event: remove\ndata: {\"id\":\"v2\",\"type\":\"vehicle\"}\n\n"))
+			return
+		}
+
+		// Reconnection: add a vehicle and hold the stream open
+		w.Write([]byte("event: add\ndata: " + vehicle("v3", 30) + "\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	tmpfile, err := os.CreateTemp("", "test*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	clock := newFakeClock(time.Now())
+	p, err := pipeline.NewETLPipeline(server.URL, tmpfile.Name(), pipeline.WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Stream(ctx)
+	}()
+
+	// After the first connection drops the stream backs off before reconnecting
+	wait := clock.next(t)
+	if wait.d != time.Second {
+		t.Errorf("Expected initial backoff of 1s, got %v", wait.d)
+	}
+
+	count, err := p.CountVehicles()
+	if err != nil {
+		t.Fatalf("Failed to query database: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 vehicle after remove, got %d", count)
+	}
+
+	speed, err := p.GetVehicleSpeed("v1")
+	if err != nil {
+		t.Fatalf("Failed to query speed: %v", err)
+	}
+	if speed == nil || *speed != 15.0 {
+		t.Errorf("Expected updated speed 15.0, got %s", formatOptional("%.2f", speed))
+	}
+
+	clock.fire(wait)
+	waitFor(t, "vehicle added after reconnect", func() bool {
+		_, err := p.GetVehicleSpeed("v3")
+		return err == nil
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream did not stop after cancellation")
 	}
-	avgSpeedStr = strings.TrimSuffix(avgSpeedStr, " mph")
-	avgSpeed, err := strconv.ParseFloat(avgSpeedStr, 64)
+}
+
+// streamEvents serves events on one stream connection, lets p consume them
+// and stops the stream once the connection drops
+func streamEvents(t *testing.T, dbPath, events string, opts ...pipeline.Option) *pipeline.ETLPipeline {
+	t.Helper()
+	return streamEventsAt(t, dbPath, "", events, opts...)
+}
+
+// streamEventsAt is streamEvents with path appended to the server URL
+func streamEventsAt(t *testing.T, dbPath, path, events string, opts ...pipeline.Option) *pipeline.ETLPipeline {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(events))
+	}))
+	t.Cleanup(server.Close)
+
+	clock := newFakeClock(time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC))
+	p, err := pipeline.NewETLPipeline(server.URL+path, dbPath, append(opts, pipeline.WithClock(clock))...)
 	if err != nil {
-			t.Fatalf("Failed to parse average_speed: %v", err)
+		t.Fatalf("Failed to create p: %v", err)
 	}
-	if avgSpeed != 20.0 {
-			t.Errorf("Expected average speed 20.0, got %.2f", avgSpeed)
+	t.Cleanup(func() { p.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Stream(ctx)
+	}()
+	clock.next(t)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Stream failed: %v", err)
 	}
+	return p
+}
+
+// Test Stream - Each connection is recorded in the run ledger
+func TestStreamRecordsRuns(t *testing.T) {
+	events := "event: reset\ndata: [" +
+		`{"id":"a","attributes":{"label":"a","updated_at":"2024-01-15T10:30:00-05:00","latitude":42.36,"longitude":-71.05}},` +
+		`{"id":"b","attributes":{"label":"b","updated_at":"2024-01-15T10:30:00-05:00","latitude":91,"longitude":-71.05}}` + "]\n\n" +
+		"event: update\ndata: " +
+		`{"id":"a","attributes":{"label":"a","updated_at":"2024-01-15T10:31:00-05:00","latitude":42.37,"longitude":-71.05}}` + "\n\n"
+	p := streamEvents(t, t.TempDir()+"/etl.db", events, pipeline.WithValidation(pipeline.DefaultValidationRules))
 
-	maxSpeedStr, ok := stats["max_speed"].(string)
-	if !ok {
-			t.Fatalf("max_speed is not a string")
+	runs, err := p.GetRecentRuns(10)
+	if err != nil {
+		t.Fatalf("GetRecentRuns failed: %v", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("Expected one run for the connection, got %+v", runs)
+	}
+	run := runs[0]
+	if run.FinishedAt == nil || run.Error != "" || run.HTTPStatus != http.StatusOK {
+		t.Errorf("Expected a finished run, got %+v", run)
+	}
+	if run.Extracted != 3 || run.Rejected != 1 || run.Loaded != 2 {
+		t.Errorf("Expected 3 extracted, 1 rejected and 2 loaded, got %+v", run)
 	}
-	maxSpeedStr = strings.TrimSuffix(maxSpeedStr, " mph")
-	maxSpeed, err := strconv.ParseFloat(maxSpeedStr, 64)
+
+	v, err := p.GetVehicle("a")
 	if err != nil {
-			t.Fatalf("Failed to parse max_speed: %v", err)
+		t.Fatalf("GetVehicle failed: %v", err)
+	}
+	if v.RunID != run.ID {
+		t.Errorf("Expected vehicle tagged with run %d, got %d", run.ID, v.RunID)
+	}
+}
+
+// Test Stream - A filtered reset leaves vehicles outside the filter alone
+func TestStreamFilteredReset(t *testing.T) {
+	updatedAt := time.Date(2024, 1, 15, 15, 0, 0, 0, time.UTC)
+	reset := "event: reset\ndata: [" +
+		`{"id":"red-1","attributes":{"label":"1801","updated_at":"2024-01-15T10:30:00-05:00","latitude":42.36,"longitude":-71.05},` +
+		`"relationships":{"route":{"data":{"id":"Red","type":"route"}}}}` + "]\n\n"
+
+	tests := []struct {
+		name string
+		path string
+		opts []pipeline.Option
+		want []string // active vehicles after the reset
+	}{
+		{"unfiltered", "", nil, []string{"red-1"}},
+		{"filter option", "", []pipeline.Option{
+			pipeline.WithExtractOptions(pipeline.ExtractOptions{Filter: map[string]string{"route": "Red"}}),
+		}, []string{"orange-1", "red-1", "red-2"}},
+		{"filter in API URL", "/vehicles?filter[route]=Red", nil, []string{"orange-1", "red-1", "red-2"}},
+		{"page limit in API URL", "/vehicles?page[limit]=1", nil, []string{"orange-1", "red-1", "red-2"}},
+		{"max age", "/vehicles?filter[route]=Red", []pipeline.Option{
+			pipeline.WithStalePolicy(pipeline.StalePolicy{Absent: true, MaxAge: 10 * time.Minute}),
+		}, []string{"red-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := t.TempDir() + "/etl.db"
+			seed, err := pipeline.NewETLPipeline("", dbPath)
+			if err != nil {
+				t.Fatalf("Failed to create p: %v", err)
+			}
+			err = seed.Load([]VehicleRecord{
+				{ID: "red-1", RouteID: "Red", UpdatedAt: updatedAt, IngestedAt: updatedAt},
+				{ID: "red-2", RouteID: "Red", UpdatedAt: updatedAt, IngestedAt: updatedAt},
+				{ID: "orange-1", RouteID: "Orange", UpdatedAt: updatedAt, IngestedAt: updatedAt},
+			})
+			seed.Close()
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			p := streamEventsAt(t, dbPath, tt.path, reset, tt.opts...)
+
+			vehicles, err := p.GetVehicles()
+			if err != nil {
+				t.Fatalf("GetVehicles failed: %v", err)
+			}
+			var got []string
+			for _, v := range vehicles {
+				got = append(got, v.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected active vehicles %v, got %v", tt.want, got)
+			}
+			if v, err := p.GetVehicle("red-1"); err != nil || !v.UpdatedAt.Equal(updatedAt.Add(30*time.Minute)) {
+				t.Errorf("Expected reset to update red-1, got %+v, %v", v, err)
+			}
+		})
 	}
-	if maxSpeed != 30.0 {
-			t.Errorf("Expected max speed 30.0, got %.2f", maxSpeed)
+}
+
+// Test Stream - Reset and remove events retire vehicles under the stale policy
+func TestStreamRetiresVehicles(t *testing.T) {
+	vehicle := func(id string) string {
+		return `{"id":"` + id + `","attributes":{"label":"` + id + `",` +
+			`"updated_at":"2024-01-15T10:30:00-05:00","latitude":42.36,"longitude":-71.05}}`
+	}
+	events := "event: reset\ndata: [" + vehicle("a") + "," + vehicle("b") + "," + vehicle("c") + "]\n\n" +
+		"event: reset\ndata: [" + vehicle("a") + "," + vehicle("b") + "]\n\n" +
+		"event: remove\ndata: {\"id\":\"b\",\"type\":\"vehicle\"}\n\n"
+
+	tests := []struct {
+		name   string
+		policy pipeline.StalePolicy
+		want   map[string]bool // id -> stale
+	}{
+		{"mark", pipeline.DefaultStalePolicy, map[string]bool{"a": false, "b": true, "c": true}},
+		{"delete", pipeline.StalePolicy{Absent: true, Delete: true}, map[string]bool{"a": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := streamEvents(t, t.TempDir()+"/etl.db", events,
+				pipeline.WithStalePolicy(tt.policy), pipeline.WithIncludeStale(true))
+
+			vehicles, err := p.GetVehicles()
+			if err != nil {
+				t.Fatalf("GetVehicles failed: %v", err)
+			}
+			got := make(map[string]bool)
+			for _, v := range vehicles {
+				got[v.ID] = v.Stale
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected vehicles %v, got %v", tt.want, got)
+			}
+			if history, _ := p.GetVehicleHistory("c"); len(history) != 1 {
+				t.Errorf("Expected retired vehicle to keep its history, got %d positions", len(history))
+			}
+		})
 	}
-}
\ No newline at end of file
+}
+
+// Test Extract/Transform/Load - Keeps route, trip and stop relationships
+func TestRelationshipsArePersisted(t *testing.T) {
+	mockResponse := `{
+		"data": [
+			{
+				"id": "R-5463",
+				"type": "vehicle",
+				"attributes": {
+					"updated_at": "2024-01-15T10:30:00-05:00",
+					"speed": 12.5,
+					"label": "1840",
+					"latitude": 42.3601,
+					"longitude": -71.0589
+				},
+				"relationships": {
+					"route": {"data": {"id": "Red", "type": "route"}},
+					"trip": {"data": {"id": "60392455", "type": "trip"}},
+					"stop": {"data": null}
+				}
+			}
+		]
+	}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mockResponse))
+	}))
+	defer server.Close()
+
+	tmpfile, err := os.CreateTemp("", "test*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL, tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	if err := p.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	vehicles, err := p.GetTop10FastestVehicles()
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(vehicles) != 1 {
+		t.Fatalf("Expected 1 vehicle, got %d", len(vehicles))
+	}
+
+	if vehicles[0].RouteID != "Red" {
+		t.Errorf("Expected route 'Red', got '%s'", vehicles[0].RouteID)
+	}
+
+	if vehicles[0].TripID != "60392455" {
+		t.Errorf("Expected trip '60392455', got '%s'", vehicles[0].TripID)
+	}
+
+	if vehicles[0].StopID != "" {
+		t.Errorf("Expected empty stop for null relationship, got '%s'", vehicles[0].StopID)
+	}
+}
+
+// Test Query - Route breakdown joins vehicles to synced routes
+func TestGetRouteBreakdown(t *testing.T) {
+	mockRoutes := `{
+		"data": [
+			{"id": "Red", "type": "route", "attributes": {"long_name": "Red Line", "short_name": "", "type": 1, "color": "DA291C", "text_color": "FFFFFF"}},
+			{"id": "Green-B", "type": "route", "attributes": {"long_name": "Green Line B", "short_name": "B", "type": 0, "color": "00843D", "text_color": "FFFFFF"}},
+			{"id": "1", "type": "route", "attributes": {"long_name": "Harvard Square - Nubian Station", "short_name": "1", "type": 3, "color": "FFC72C", "text_color": "000000"}}
+		]
+	}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(mockRoutes))
+	}))
+	defer server.Close()
+
+	tmpfile, err := os.CreateTemp("", "test*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	p, err := pipeline.NewETLPipeline("http://test", tmpfile.Name(), pipeline.WithRoutesURL(server.URL))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	n, err := p.SyncRoutes()
+	if err != nil {
+		t.Fatalf("SyncRoutes failed: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 routes synced, got %d", n)
+	}
+
+	vehicle := func(id, route string, speed float64) VehicleRecord {
+		return VehicleRecord{
+			ID: id, Label: id, Latitude: 42.3601, Longitude: -71.0589,
+			Speed: ptr(speed), CurrentStatus: "IN_TRANSIT_TO", OccupancyStatus: "UNKNOWN",
+			RouteID: route, UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		}
+	}
+	records := []VehicleRecord{
+		vehicle("R-1", "Red", 10),
+		vehicle("R-2", "Red", 30),
+		vehicle("G-1", "Green-B", 8),
+		vehicle("y1", "1", 12),
+		vehicle("x1", "", 0),
+	}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Failed to load test data: %v", err)
+	}
+
+	routes, err := p.GetRouteBreakdown()
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(routes) != 4 {
+		t.Fatalf("Expected 4 routes, got %d", len(routes))
+	}
+
+	red := routes[0]
+	if red.RouteID != "Red" || red.LongName != "Red Line" || red.Count != 2 {
+		t.Errorf("Expected Red Line with 2 vehicles first, got %+v", red)
+	}
+	if red.AvgSpeed != 20.0 || red.MaxSpeed != 30.0 {
+		t.Errorf("Expected Red Line avg 20/max 30, got %.2f/%.2f", red.AvgSpeed, red.MaxSpeed)
+	}
+
+	types, err := p.GetRouteTypeBreakdown()
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	counts := map[string]int{}
+	for _, rt := range types {
+		counts[rt.Name] = rt.Count
+	}
+
+	expected := map[string]int{"Subway": 2, "Light Rail": 1, "Bus": 1, "Unknown": 1}
+	for name, want := range expected {
+		if counts[name] != want {
+			t.Errorf("Expected %d %s vehicles, got %d", want, name, counts[name])
+		}
+	}
+}
+
+// Test Output - Machine-readable formats share field names and numeric types
+func TestOutputFormats(t *testing.T) {
+	updatedAt := time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC)
+	vehicles := []VehicleRecord{
+		{ID: "y1838", Label: "1838", Speed: ptr(33.5), Bearing: ptr(90), RouteID: "1", UpdatedAt: updatedAt, IngestedAt: updatedAt},
+		{ID: "y1713", Label: "1713", Speed: ptr(28.2), Bearing: ptr(180), RouteID: "1", UpdatedAt: updatedAt, IngestedAt: updatedAt},
+	}
+
+	// JSON keeps numbers as numbers
+	var buf bytes.Buffer
+	if err := output.Write(&buf, output.JSON, vehicles); err != nil {
+		t.Fatalf("JSON output failed: %v", err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("Expected 2 JSON rows, got %d", len(decoded))
+	}
+	if speed, ok := decoded[0]["speed"].(float64); !ok || speed != 33.5 {
+		t.Errorf("Expected numeric speed 33.5, got %v", decoded[0]["speed"])
+	}
+
+	// NDJSON writes one object per line
+	buf.Reset()
+	if err := output.Write(&buf, output.NDJSON, vehicles); err != nil {
+		t.Fatalf("NDJSON output failed: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 NDJSON lines, got %d", len(lines))
+	}
+	var first VehicleRecord
+	if err := json.Unmarshal(lines[0], &first); err != nil {
+		t.Fatalf("Invalid NDJSON line: %v", err)
+	}
+	if first.ID != "y1838" {
+		t.Errorf("Expected first NDJSON row y1838, got %s", first.ID)
+	}
+
+	// CSV uses the same field names as JSON
+	buf.Reset()
+	if err := output.Write(&buf, output.CSV, vehicles); err != nil {
+		t.Fatalf("CSV output failed: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV output: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected header plus 2 CSV rows, got %d", len(rows))
+	}
+	if rows[0][0] != "id" || rows[0][4] != "speed" {
+		t.Errorf("Unexpected CSV header: %v", rows[0])
+	}
+	if rows[1][4] != "33.5" {
+		t.Errorf("Expected CSV speed 33.5, got %s", rows[1][4])
+	}
+
+	// A single struct is one CSV row
+	buf.Reset()
+	if err := output.Write(&buf, output.CSV, &SummaryStats{TotalVehicles: 2, AverageSpeed: 30.85}); err != nil {
+		t.Fatalf("CSV output failed: %v", err)
+	}
+	rows, err = csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV output: %v", err)
+	}
+	if len(rows) != 2 || rows[0][0] != "total_vehicles" || rows[1][1] != "30.85" {
+		t.Errorf("Unexpected stats CSV: %v", rows)
+	}
+
+	if _, err := output.ParseFormat("xml"); err == nil {
+		t.Error("Expected error for unknown format, got nil")
+	}
+}
+
+// getJSON fetches url and decodes the JSON body into v, returning the status
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type from %s, got %q", url, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Invalid JSON from %s: %v", url, err)
+	}
+	return resp.StatusCode
+}
+
+// Test API - Endpoints serve the query layer as JSON
+func TestAPIServer(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("http://test", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	records := []VehicleRecord{
+		{
+			ID: "y1838", Label: "1838", Latitude: 42.3601, Longitude: -71.0589,
+			Speed: ptr(10.0), CurrentStatus: "IN_TRANSIT_TO", OccupancyStatus: "UNKNOWN",
+			Bearing: ptr(90), RouteID: "1", UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		},
+		{
+			ID: "y1713", Label: "1713", Latitude: 42.3601, Longitude: -71.0589,
+			Speed: ptr(20.0), CurrentStatus: "STOPPED_AT", OccupancyStatus: "UNKNOWN",
+			Bearing: ptr(270), RouteID: "1", UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		},
+	}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Failed to load test data: %v", err)
+	}
+
+	server := httptest.NewServer(api.NewServer(p))
+	defer server.Close()
+
+	var vehicles []VehicleRecord
+	if status := getJSON(t, server.URL+"/vehicles", &vehicles); status != http.StatusOK {
+		t.Errorf("Expected 200 from /vehicles, got %d", status)
+	}
+	if len(vehicles) != 2 {
+		t.Errorf("Expected 2 vehicles, got %d", len(vehicles))
+	}
+
+	var vehicle VehicleRecord
+	if status := getJSON(t, server.URL+"/vehicles/y1838", &vehicle); status != http.StatusOK {
+		t.Errorf("Expected 200 from /vehicles/y1838, got %d", status)
+	}
+	if vehicle.ID != "y1838" || vehicle.Speed == nil || *vehicle.Speed != 10.0 {
+		t.Errorf("Unexpected vehicle: %+v", vehicle)
+	}
+
+	var apiErr map[string]string
+	if status := getJSON(t, server.URL+"/vehicles/missing", &apiErr); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown vehicle, got %d", status)
+	}
+	if apiErr["error"] == "" {
+		t.Error("Expected error message for unknown vehicle")
+	}
+
+	var stats SummaryStats
+	if status := getJSON(t, server.URL+"/stats", &stats); status != http.StatusOK {
+		t.Errorf("Expected 200 from /stats, got %d", status)
+	}
+	if stats.TotalVehicles != 2 || stats.AverageSpeed != 15.0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	var routes []RouteStats
+	getJSON(t, server.URL+"/routes", &routes)
+	if len(routes) != 1 || routes[0].RouteID != "1" || routes[0].Count != 2 {
+		t.Errorf("Unexpected routes: %+v", routes)
+	}
+
+	var east []VehicleRecord
+	getJSON(t, server.URL+"/bearing?target=90&delta=15", &east)
+	if len(east) != 1 || east[0].ID != "y1838" {
+		t.Errorf("Expected only y1838 heading east, got %+v", east)
+	}
+
+	if status := getJSON(t, server.URL+"/bearing?target=east", &apiErr); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid target, got %d", status)
+	}
+
+	var summary []BearingBucket
+	getJSON(t, server.URL+"/bearing/summary", &summary)
+	if len(summary) != 8 || summary[2].Direction != "East" || summary[2].Count != 1 || summary[6].Count != 1 {
+		t.Errorf("Unexpected bearing summary: %v", summary)
+	}
+}
+
+// Test GeoJSON - Exports filtered vehicles as Point features
+func TestGetGeoJSON(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("http://test", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	vehicle := func(id, route, status string, lat, lon float64) VehicleRecord {
+		return VehicleRecord{
+			ID: id, Label: id, Latitude: lat, Longitude: lon, Speed: ptr(12.5),
+			CurrentStatus: status, OccupancyStatus: "UNKNOWN", Bearing: ptr(45),
+			RouteID: route, UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		}
+	}
+	records := []VehicleRecord{
+		vehicle("R-1", "Red", "STOPPED_AT", 42.3555, -71.0605),
+		vehicle("R-2", "Red", "IN_TRANSIT_TO", 42.2084, -71.0010),
+		vehicle("y1", "1", "STOPPED_AT", 42.3601, -71.0589),
+	}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Failed to load test data: %v", err)
+	}
+
+	fc, err := p.GetGeoJSON(pipeline.VehicleFilter{RouteID: "Red"})
+	if err != nil {
+		t.Fatalf("GetGeoJSON failed: %v", err)
+	}
+	if len(fc.Features) != 2 {
+		t.Fatalf("Expected 2 Red Line features, got %d", len(fc.Features))
+	}
+
+	// Serialized output must be valid GeoJSON with [lon, lat] points
+	data, err := json.Marshal(fc)
+	if err != nil {
+		t.Fatalf("Failed to marshal GeoJSON: %v", err)
+	}
+	var decoded struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Type     string `json:"type"`
+			ID       string `json:"id"`
+			Geometry struct {
+				Type        string    `json:"type"`
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Invalid GeoJSON: %v", err)
+	}
+	if decoded.Type != "FeatureCollection" {
+		t.Errorf("Expected FeatureCollection, got %s", decoded.Type)
+	}
+	first := decoded.Features[0]
+	if first.Type != "Feature" || first.Geometry.Type != "Point" || first.ID != "R-1" {
+		t.Errorf("Unexpected feature: %+v", first)
+	}
+	if first.Geometry.Coordinates[0] != -71.0605 || first.Geometry.Coordinates[1] != 42.3555 {
+		t.Errorf("Expected [lon, lat] coordinates, got %v", first.Geometry.Coordinates)
+	}
+	if first.Properties["route_id"] != "Red" || first.Properties["speed"] != 12.5 {
+		t.Errorf("Unexpected properties: %v", first.Properties)
+	}
+
+	// Status and bounding box filters combine
+	bbox, err := pipeline.ParseBoundingBox("-71.1,42.3,-71.0,42.4")
+	if err != nil {
+		t.Fatalf("ParseBoundingBox failed: %v", err)
+	}
+	fc, err = p.GetGeoJSON(pipeline.VehicleFilter{Status: "STOPPED_AT", BBox: bbox})
+	if err != nil {
+		t.Fatalf("GetGeoJSON failed: %v", err)
+	}
+	if len(fc.Features) != 2 {
+		t.Errorf("Expected 2 stopped vehicles downtown, got %d", len(fc.Features))
+	}
+
+	if _, err := pipeline.ParseBoundingBox("-71.0,42.4,-71.1,42.3"); err == nil {
+		t.Error("Expected error for inverted bounding box, got nil")
+	}
+}
+
+// Test Query - Bearing cone wraps around 0/360 and sorts by distance
+func TestGetVehiclesByBearingWrapsAround(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("http://test", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	records := []VehicleRecord{}
+	for _, bearing := range []int{10, 180, 350, 5, 30, 355} {
+		id := "v" + strconv.Itoa(bearing)
+		records = append(records, VehicleRecord{
+			ID: id, Label: id, Latitude: 42.3601, Longitude: -71.0589,
+			CurrentStatus: "IN_TRANSIT_TO", OccupancyStatus: "UNKNOWN",
+			Bearing: ptr(bearing), UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		})
+	}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Failed to load test data: %v", err)
+	}
+
+	// -5 normalizes to 355, matching the same vehicles
+	for _, target := range []float64{355, -5, 715} {
+		vehicles, err := p.GetVehiclesByBearing(target, 15)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		var got []int
+		for _, v := range vehicles {
+			got = append(got, *v.Bearing)
+		}
+
+		expected := []int{355, 350, 5, 10}
+		if len(got) != len(expected) {
+			t.Fatalf("Target %.0f: expected bearings %v, got %v", target, expected, got)
+		}
+		for i := range expected {
+			if got[i] != expected[i] {
+				t.Errorf("Target %.0f: expected bearings %v sorted by distance, got %v", target, expected, got)
+				break
+			}
+		}
+	}
+
+	if d := pipeline.AngularDistance(350, 10); d != 20 {
+		t.Errorf("Expected angular distance 20, got %.1f", d)
+	}
+}
+
+// Test Query - Bearing summary uses a fixed compass order
+func TestGetBearingSummaryOrder(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("http://test", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	records := []VehicleRecord{}
+	for _, bearing := range []int{0, 359, 22, 23, 90, 180, 270, 315} {
+		id := "v" + strconv.Itoa(bearing)
+		records = append(records, VehicleRecord{
+			ID: id, Label: id, Latitude: 42.3601, Longitude: -71.0589,
+			CurrentStatus: "IN_TRANSIT_TO", OccupancyStatus: "UNKNOWN",
+			Bearing: ptr(bearing), UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		})
+	}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Failed to load test data: %v", err)
+	}
+
+	summary, err := p.GetBearingSummary()
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	expected := []BearingBucket{
+		{Direction: "North", Count: 3},
+		{Direction: "Northeast", Count: 1},
+		{Direction: "East", Count: 1},
+		{Direction: "Southeast", Count: 0},
+		{Direction: "South", Count: 1},
+		{Direction: "Southwest", Count: 0},
+		{Direction: "West", Count: 1},
+		{Direction: "Northwest", Count: 1},
+	}
+	if len(summary) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %d", len(expected), len(summary))
+	}
+	for i := range expected {
+		if summary[i] != expected[i] {
+			t.Errorf("Bucket %d: expected %+v, got %+v", i, expected[i], summary[i])
+		}
+	}
+}
+
+// Test Extract - Follows links.next and sends typed query options
+func TestExtractFollowsPagination(t *testing.T) {
+	vehicle := func(id string) string {
+		return `{"id":"` + id + `","type":"vehicle","attributes":{` +
+			`"updated_at":"2024-01-15T10:30:00-05:00","label":"` + id + `",` +
+			`"latitude":42.3601,"longitude":-71.0589}}`
+	}
+
+	var serverURL string
+	var firstQuery map[string][]string
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+
+		switch r.URL.Query().Get("page[offset]") {
+		case "":
+			firstQuery = r.URL.Query()
+			// Relative next link
+			w.Write([]byte(`{"data":[` + vehicle("v1") + `,` + vehicle("v2") + `],` +
+				`"links":{"next":"/vehicles?page[offset]=2&page[limit]=2"}}`))
+		case "2":
+			// Absolute next link
+			w.Write([]byte(`{"data":[` + vehicle("v3") + `,` + vehicle("v4") + `],` +
+				`"links":{"next":"` + serverURL + `/vehicles?page[offset]=4&page[limit]=2"}}`))
+		case "4":
+			w.Write([]byte(`{"data":[` + vehicle("v5") + `],"links":{}}`))
+		default:
+			t.Errorf("Unexpected page request: %s", r.URL)
+		}
+	}))
+	defer server.Close()
+	serverURL = server.URL
+
+	p, err := pipeline.NewETLPipeline(server.URL+"/vehicles", ":memory:", pipeline.WithExtractOptions(pipeline.ExtractOptions{
+		Filter:    map[string]string{"route": "Red"},
+		Fields:    map[string][]string{"vehicle": {"label", "latitude", "longitude", "updated_at"}},
+		Include:   []string{"trip", "route"},
+		PageLimit: 2,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	resp, err := p.Extract()
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if len(resp.Data) != 5 {
+		t.Errorf("Expected 5 vehicles merged from 3 pages, got %d", len(resp.Data))
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("Expected 3 page requests, got %d", got)
+	}
+	if resp.Data[4].ID != "v5" {
+		t.Errorf("Expected last vehicle v5, got %s", resp.Data[4].ID)
+	}
+
+	expected := map[string]string{
+		"filter[route]":   "Red",
+		"fields[vehicle]": "label,latitude,longitude,updated_at,speed,direction_id,current_status,occupancy_status,bearing,route,trip,stop",
+		"include":         "trip,route",
+		"page[limit]":     "2",
+	}
+	for key, want := range expected {
+		if got := firstQuery[key]; len(got) != 1 || got[0] != want {
+			t.Errorf("Expected %s=%s on first request, got %v", key, want, got)
+		}
+	}
+}
+
+// Test Extract - A sparse fieldset always keeps the fields Load stores
+func TestExtractSparseFieldsKeepStoredFields(t *testing.T) {
+	var fields string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields = r.URL.Query().Get("fields[vehicle]")
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer server.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL+"/vehicles?fields[vehicle]=latitude,longitude", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Extract(); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	want := "latitude,longitude,label,speed,direction_id,current_status,occupancy_status,bearing,updated_at,route,trip,stop"
+	if fields != want {
+		t.Errorf("Expected fields[vehicle]=%s, got %s", want, fields)
+	}
+}
+
+// Test Extract - Retries transient failures and gives up on permanent ones
+func TestExtractRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&requests, 1); {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		case n <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"data": []}`))
+		}
+	}))
+	defer server.Close()
+
+	policy := pipeline.WithRetryPolicy(pipeline.RetryPolicy{
+		MaxRetries: 2,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   5 * time.Millisecond,
+	})
+
+	// Two 503s then success
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:", policy)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Extract(); err != nil {
+		t.Fatalf("Expected success after retries, got %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("Expected 3 requests, got %d", got)
+	}
+
+	// 404 is permanent and not retried
+	atomic.StoreInt32(&requests, 0)
+	missing, err := pipeline.NewETLPipeline(server.URL+"/missing", ":memory:", policy)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer missing.Close()
+
+	_, err = missing.Extract()
+	var fetchErr *pipeline.FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("Expected FetchError, got %v", err)
+	}
+	if fetchErr.Transient || pipeline.IsTransient(err) || fetchErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected permanent 404 failure, got %+v", fetchErr)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("Expected 1 request for permanent failure, got %d", got)
+	}
+
+	// Persistent 5xx gives up after MaxRetries as a transient failure
+	atomic.StoreInt32(&requests, 0)
+	down, err := pipeline.NewETLPipeline(server.URL+"/down", ":memory:", policy)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer down.Close()
+
+	_, err = down.Extract()
+	if !pipeline.IsTransient(err) {
+		t.Errorf("Expected transient failure, got %v", err)
+	}
+	if errors.As(err, &fetchErr) && fetchErr.Attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", fetchErr.Attempts)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("Expected 3 requests before giving up, got %d", got)
+	}
+}
+
+// Test Extract - 429 waits until x-ratelimit-reset before retrying
+func TestExtractHonoursRateLimitReset(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC))
+	reset := clock.Now().Add(42 * time.Second).Unix()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("x-ratelimit-remaining", "0")
+			w.Header().Set("x-ratelimit-reset", strconv.FormatInt(reset, 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer server.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:", pipeline.WithClock(clock))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Extract()
+		done <- err
+	}()
+
+	wait := clock.next(t)
+	if wait.d != 42*time.Second {
+		t.Errorf("Expected to wait 42s for rate limit reset, got %v", wait.d)
+	}
+	clock.fire(wait)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected success after rate limit reset, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Extract did not retry after rate limit reset")
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("Expected 2 requests, got %d", got)
+	}
+}
+
+// roundTripFunc adapts a function into an http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Test Extract - Sends API key and user agent through a custom client
+func TestExtractHTTPClientOptions(t *testing.T) {
+	var gotKey, gotAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-api-key")
+		gotAgent = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer server.Close()
+
+	var viaTransport int32
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&viaTransport, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:",
+		pipeline.WithAPIKey("secret-key"),
+		pipeline.WithUserAgent("etl-test/1.0"),
+		pipeline.WithHTTPClient(client),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Extract(); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if gotKey != "secret-key" {
+		t.Errorf("Expected x-api-key 'secret-key', got %q", gotKey)
+	}
+	if gotAgent != "etl-test/1.0" {
+		t.Errorf("Expected User-Agent 'etl-test/1.0', got %q", gotAgent)
+	}
+	if atomic.LoadInt32(&viaTransport) != 1 {
+		t.Errorf("Expected request through custom transport")
+	}
+}
+
+// Test Extract - Request timeout is a transient failure
+func TestExtractTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:",
+		pipeline.WithTimeout(50*time.Millisecond),
+		pipeline.WithRetryPolicy(pipeline.RetryPolicy{}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	_, err = p.Extract()
+	if err == nil {
+		t.Fatal("Expected timeout error, got nil")
+	}
+	if !pipeline.IsTransient(err) {
+		t.Errorf("Expected timeout to be transient, got %v", err)
+	}
+}
+
+// Test Extract - Transport errors are only transient if a retry could help
+func TestExtractTransportErrors(t *testing.T) {
+	noRetry := pipeline.WithRetryPolicy(pipeline.RetryPolicy{})
+
+	// An unsupported scheme fails the same way every time
+	p, err := pipeline.NewETLPipeline("ftp://example.invalid/vehicles", ":memory:", noRetry)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+	if _, err := p.Extract(); err == nil || pipeline.IsTransient(err) {
+		t.Errorf("Expected a permanent error for an unsupported scheme, got %v", err)
+	}
+
+	// A refused connection may work next time
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	refused, err := pipeline.NewETLPipeline(closed.URL, ":memory:", noRetry)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer refused.Close()
+	if _, err := refused.Extract(); !pipeline.IsTransient(err) {
+		t.Errorf("Expected a refused connection to be transient, got %v", err)
+	}
+
+	// A timeout while reading the body is a transient fetch error, not bad JSON
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	slow, err := pipeline.NewETLPipeline(server.URL, ":memory:", noRetry, pipeline.WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer slow.Close()
+	_, err = slow.Extract()
+	var fetchErr *pipeline.FetchError
+	if !errors.As(err, &fetchErr) || !fetchErr.Transient {
+		t.Errorf("Expected a transient FetchError for a body timeout, got %v", err)
+	}
+}
+
+// Test Run - Conditional requests skip unchanged polls across restarts
+func TestRunSkipsUnchangedPolls(t *testing.T) {
+	var requests, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 15 Jan 2024 15:30:00 GMT")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data":[{"id":"v1","type":"vehicle","attributes":{` +
+			`"updated_at":"2024-01-15T10:30:00-05:00","label":"1001",` +
+			`"latitude":42.3601,"longitude":-71.0589,"speed":12.5}}]}`))
+	}))
+	defer server.Close()
+
+	dbPath := t.TempDir() + "/etl.db"
+	p, err := pipeline.NewETLPipeline(server.URL, dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+
+	result, err := p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("First run failed: %v", err)
+	}
+	if result.NotModified || result.Loaded != 1 {
+		t.Errorf("Expected first run to load 1 record, got %+v", result)
+	}
+	p.Close()
+
+	// The saved ETag is sent by a fresh pipeline on the same database
+	p, err = pipeline.NewETLPipeline(server.URL, dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen p: %v", err)
+	}
+	defer p.Close()
+
+	result, err = p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if !result.NotModified {
+		t.Error("Expected second run to report NotModified")
+	}
+	if result.Extracted != 0 || result.Loaded != 0 {
+		t.Errorf("Expected nothing extracted or loaded, got %+v", result)
+	}
+	if got := atomic.LoadInt32(&notModified); got != 1 {
+		t.Errorf("Expected 1 conditional hit, got %d", got)
+	}
+
+	history, err := p.GetVehicleHistory("v1")
+	if err != nil {
+		t.Fatalf("GetVehicleHistory failed: %v", err)
+	}
+	if len(history) != 1 {
+		t.Errorf("Expected 1 stored position, got %d", len(history))
+	}
+}
+
+// Test Run - Paged responses are never skipped on a 304 for the first page
+func TestRunFetchesPagedResponsesInFull(t *testing.T) {
+	vehicle := func(id string) string {
+		return `{"id":"` + id + `","type":"vehicle","attributes":{` +
+			`"updated_at":"2024-01-15T10:30:00-05:00","label":"` + id + `","latitude":42.36,"longitude":-71.05}}`
+	}
+	var conditional int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Query().Get("page[offset]") == "" {
+			w.Write([]byte(`{"data":[` + vehicle("v1") + `],"links":{"next":"/vehicles?page[offset]=1&page[limit]=1"}}`))
+			return
+		}
+		w.Write([]byte(`{"data":[` + vehicle("v2") + `]}`))
+	}))
+	defer server.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL+"/vehicles", t.TempDir()+"/etl.db",
+		pipeline.WithExtractOptions(pipeline.ExtractOptions{PageLimit: 1}))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	for run := 1; run <= 2; run++ {
+		result, err := p.RunContext(context.Background())
+		if err != nil {
+			t.Fatalf("Run %d failed: %v", run, err)
+		}
+		if result.NotModified || result.Loaded != 2 {
+			t.Errorf("Expected run %d to load both pages, got %+v", run, result)
+		}
+	}
+	if got := atomic.LoadInt32(&conditional); got != 0 {
+		t.Errorf("Expected no conditional requests for a paged response, got %d", got)
+	}
+}
+
+// syntheticFeed builds a vehicles document with n vehicles
+func syntheticFeed(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"jsonapi":{"version":"1.0"},"data":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"id":"y%d","type":"vehicle","attributes":{`+
+			`"updated_at":"2024-01-15T10:30:00-05:00","speed":%d.5,"bearing":%d,`+
+			`"current_status":"IN_TRANSIT_TO","occupancy_status":"MANY_SEATS_AVAILABLE",`+
+			`"label":"%d","direction_id":%d,"latitude":42.36,"longitude":-71.05},`+
+			`"relationships":{"route":{"data":{"id":"Red","type":"route"}},"trip":{"data":null}}}`,
+			i, i%40, i%360, i, i%2)
+	}
+	buf.WriteString(`],"links":{"next":"/vehicles?page[offset]=2"},"included":[{"id":"Red","type":"route"}]}`)
+	return buf.Bytes()
+}
+
+// Test DecodeVehicles - Streams data[] and keeps links and included
+func TestDecodeVehicles(t *testing.T) {
+	var ids []string
+	doc, err := pipeline.DecodeVehicles(bytes.NewReader(syntheticFeed(3)), func(v Vehicle) error {
+		ids = append(ids, v.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeVehicles failed: %v", err)
+	}
+
+	if len(ids) != 3 || ids[0] != "y0" || ids[2] != "y2" {
+		t.Errorf("Expected vehicles y0..y2 in order, got %v", ids)
+	}
+	if doc.Data != nil {
+		t.Errorf("Expected no buffered data, got %d vehicles", len(doc.Data))
+	}
+	if doc.Links == nil || doc.Links.Next != "/vehicles?page[offset]=2" {
+		t.Errorf("Expected next link to be decoded, got %+v", doc.Links)
+	}
+	if len(doc.Included) != 1 {
+		t.Errorf("Expected 1 included resource, got %d", len(doc.Included))
+	}
+
+	// A callback error stops decoding
+	stop := errors.New("stop")
+	calls := 0
+	_, err = pipeline.DecodeVehicles(bytes.NewReader(syntheticFeed(5)), func(v Vehicle) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected decoding to stop after 1 call with callback error, got %d calls, %v", calls, err)
+	}
+
+	// Null data and malformed documents
+	if _, err := pipeline.DecodeVehicles(strings.NewReader(`{"data":null}`), func(Vehicle) error { return nil }); err != nil {
+		t.Errorf("Expected null data to decode, got %v", err)
+	}
+	for _, bad := range []string{`[]`, `{"data":{}}`, `{"data":[{"id":1}]}`, `{"data":[`} {
+		if _, err := pipeline.DecodeVehicles(strings.NewReader(bad), func(Vehicle) error { return nil }); err == nil {
+			t.Errorf("Expected error decoding %s", bad)
+		}
+	}
+}
+
+// Test LoadFrom - Loads a large document in batches
+func TestLoadFrom(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	result, err := p.LoadFrom(bytes.NewReader(syntheticFeed(2500)))
+	if err != nil {
+		t.Fatalf("LoadFrom failed: %v", err)
+	}
+	if result.Extracted != 2500 || result.Transformed != 2500 || result.Loaded != 2500 {
+		t.Errorf("Expected 2500 extracted, transformed and loaded, got %+v", result)
+	}
+
+	count, err := p.CountVehicles()
+	if err != nil {
+		t.Fatalf("CountVehicles failed: %v", err)
+	}
+	if count != 2500 {
+		t.Errorf("Expected 2500 vehicles stored, got %d", count)
+	}
+
+	vehicle, err := p.GetVehicle("y2499")
+	if err != nil {
+		t.Fatalf("GetVehicle failed: %v", err)
+	}
+	if vehicle.RouteID != "Red" || vehicle.Bearing == nil || *vehicle.Bearing != 2499%360 {
+		t.Errorf("Expected last vehicle to be fully loaded, got %+v", vehicle)
+	}
+	if result.RunID == 0 || vehicle.RunID != result.RunID {
+		t.Errorf("Expected vehicles tagged with run %d, got %d", result.RunID, vehicle.RunID)
+	}
+
+	runs, err := p.GetRecentRuns(1)
+	if err != nil {
+		t.Fatalf("GetRecentRuns failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].ID != result.RunID || runs[0].Loaded != 2500 || runs[0].FinishedAt == nil {
+		t.Errorf("Expected LoadFrom recorded in the run ledger, got %+v", runs)
+	}
+}
+
+// Test Run - Streams API pages through Transform and Load in batches
+func TestRunLoadsInBatches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page[offset]") != "" {
+			w.Write([]byte(`{"data":[]}`))
+			return
+		}
+		w.Write(syntheticFeed(1500))
+	}))
+	defer server.Close()
+
+	sink := &recordingLoader{}
+	p, err := pipeline.NewETLPipeline(server.URL+"/vehicles", ":memory:", pipeline.WithLoader(sink))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	result, err := p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Extracted != 1500 || result.Transformed != 1500 || result.Loaded != 1500 {
+		t.Errorf("Expected 1500 extracted, transformed and loaded, got %+v", result)
+	}
+	if !reflect.DeepEqual(sink.batches, []int{1000, 500}) {
+		t.Errorf("Expected batches of 1000 and 500, got %v", sink.batches)
+	}
+	if len(sink.records) == 0 || sink.records[0].RunID != result.RunID {
+		t.Errorf("Expected records tagged with run %d", result.RunID)
+	}
+
+	runs, err := p.GetRecentRuns(1)
+	if err != nil {
+		t.Fatalf("GetRecentRuns failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Error != "" || runs[0].Loaded != 1500 || runs[0].HTTPStatus != http.StatusOK {
+		t.Errorf("Expected a successful run of 1500 in the ledger, got %+v", runs)
+	}
+}
+
+// Benchmark decoding a 100k vehicle payload by buffering and unmarshalling it
+func BenchmarkDecodeUnmarshal(b *testing.B) {
+	feed := syntheticFeed(100000)
+	b.SetBytes(int64(len(feed)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		body, err := io.ReadAll(bytes.NewReader(feed))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var resp VehicleResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark streaming the same payload through DecodeVehicles
+func BenchmarkDecodeVehicles(b *testing.B) {
+	feed := syntheticFeed(100000)
+	b.SetBytes(int64(len(feed)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := pipeline.DecodeVehicles(bytes.NewReader(feed), func(Vehicle) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Test Archive and Replay - Raw responses are saved and can be reloaded offline
+func TestArchiveAndReplay(t *testing.T) {
+	vehicle := func(id string, speed int) string {
+		return `{"id":"` + id + `","type":"vehicle","attributes":{` +
+			`"updated_at":"2024-01-15T10:30:00-05:00","label":"` + id + `",` +
+			`"latitude":42.3601,"longitude":-71.0589,"speed":` + strconv.Itoa(speed) + `}}`
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		switch r.URL.Query().Get("page[offset]") {
+		case "":
+			w.Write([]byte(`{"data":[` + vehicle("v1", 10) + `],"links":{"next":"/?page[offset]=1"}}` + "\n"))
+		case "1":
+			w.Write([]byte(`{"data":[` + vehicle("v2", 20) + `],"links":{"next":"/?page[offset]=2"}}`))
+		default:
+			w.Write([]byte(`{"data":[` + vehicle("v3", 30) + `,`)) // truncated
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:", pipeline.WithArchiveDir(dir))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	if err := p.Run(); err == nil {
+		t.Fatal("Expected run to fail on the truncated page")
+	}
+
+	// Only the two complete pages are archived, in order
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to list archive: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 archived responses, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "vehicles-") || !strings.HasSuffix(entry.Name(), ".json.gz") {
+			t.Errorf("Unexpected archive file %s", entry.Name())
+		}
+	}
+
+	replayed, err := pipeline.NewETLPipeline("", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create replay pipeline: %v", err)
+	}
+	defer replayed.Close()
+
+	result, err := replayed.Replay(dir)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if result.Extracted != 2 || result.Loaded != 2 {
+		t.Errorf("Expected 2 records replayed, got %+v", result)
+	}
+	v2, err := replayed.GetVehicle("v2")
+	if err != nil {
+		t.Fatalf("GetVehicle failed: %v", err)
+	}
+	if v2.Speed == nil || *v2.Speed != 20 {
+		t.Errorf("Expected replayed speed 20, got %s", formatOptional("%.1f", v2.Speed))
+	}
+
+	// A single uncompressed file can be replayed too
+	file := t.TempDir() + "/vehicles.json"
+	if err := os.WriteFile(file, []byte(`{"data":[`+vehicle("v3", 30)+`]}`), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if result, err := replayed.Replay(file); err != nil || result.Loaded != 1 {
+		t.Errorf("Expected 1 record replayed from file, got %+v, %v", result, err)
+	}
+}
+
+// Test GTFS-RT source - VehiclePositions protobuf fixture goes through Run
+func TestRunGTFSRealtime(t *testing.T) {
+	feed, err := os.ReadFile("testdata/vehicle_positions.pb")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	var rawQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(feed)
+	}))
+	defer server.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL+"/VehiclePositions.pb", ":memory:",
+		pipeline.WithSource(pipeline.SourceGTFSRT),
+		pipeline.WithExtractOptions(pipeline.ExtractOptions{PageLimit: 10}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	result, err := p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	// The deleted entity and the trip update are skipped
+	if result.Extracted != 2 || result.Loaded != 2 {
+		t.Errorf("Expected 2 vehicles extracted and loaded, got %+v", result)
+	}
+	if rawQuery != "" {
+		t.Errorf("Expected no JSON:API query parameters, got %q", rawQuery)
+	}
+
+	full, err := p.GetVehicle("R-5482E4A5")
+	if err != nil {
+		t.Fatalf("GetVehicle failed: %v", err)
+	}
+	if full.Label != "1877" || !reflect.DeepEqual(full.Speed, ptr(8.5)) || !reflect.DeepEqual(full.Bearing, ptr(135)) || full.DirectionID != 1 {
+		t.Errorf("Unexpected label/speed/bearing/direction: %+v", full)
+	}
+	if full.CurrentStatus != "STOPPED_AT" || full.OccupancyStatus != "FEW_SEATS_AVAILABLE" {
+		t.Errorf("Unexpected statuses: %s, %s", full.CurrentStatus, full.OccupancyStatus)
+	}
+	if full.RouteID != "Red" || full.TripID != "60392455" || full.StopID != "70077" {
+		t.Errorf("Unexpected route/trip/stop: %s/%s/%s", full.RouteID, full.TripID, full.StopID)
+	}
+	if full.Latitude < 42.352 || full.Latitude > 42.353 || full.Longitude > -71.055 || full.Longitude < -71.056 {
+		t.Errorf("Unexpected position: %f, %f", full.Latitude, full.Longitude)
+	}
+	if want := time.Date(2024, 1, 15, 15, 29, 50, 0, time.UTC); !full.UpdatedAt.Equal(want) {
+		t.Errorf("Expected updated_at %v, got %v", want, full.UpdatedAt)
+	}
+
+	// Missing optional fields are treated like null JSON:API attributes
+	sparse, err := p.GetVehicle("y1712")
+	if err != nil {
+		t.Fatalf("GetVehicle for entity id failed: %v", err)
+	}
+	if sparse.Speed != nil || sparse.Bearing != nil || sparse.CurrentStatus != "UNKNOWN" || sparse.RouteID != "1" {
+		t.Errorf("Unexpected defaults: %+v", sparse)
+	}
+	if want := time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC); !sparse.UpdatedAt.Equal(want) {
+		t.Errorf("Expected header timestamp %v, got %v", want, sparse.UpdatedAt)
+	}
+
+	// Archived feeds replay through the same decoder
+	replayed, err := p.Replay("testdata/vehicle_positions.pb")
+	if err != nil || replayed.Loaded != 2 {
+		t.Errorf("Expected fixture to replay 2 vehicles, got %+v, %v", replayed, err)
+	}
+
+	if err := pipeline.DecodeGTFSRT(strings.NewReader("not a protobuf"), func(Vehicle) error { return nil }); err == nil {
+		t.Error("Expected error decoding invalid protobuf")
+	}
+}
+
+// writeZip writes files to a new zip archive at path
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to add %s: %v", name, err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zip: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("Failed to write zip: %v", err)
+	}
+}
+
+// Test ImportGTFS - Static feed is loaded and re-imports replace it
+func TestImportGTFS(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := dir + "/gtfs.db"
+	feed := map[string]string{
+		// Byte order mark, quoted fields and an extra column
+		"routes.txt": "\ufeffroute_id,agency_id,route_short_name,route_long_name,route_type,route_color,route_sort_order\n" +
+			"Red,1,,Red Line,1,DA291C,10010\n" +
+			"1,1,1,\"Harvard Square - Nubian Station\",3,FFC72C,50010\n",
+		"stops.txt": "stop_id,stop_name,stop_lat,stop_lon,location_type,parent_station\n" +
+			"place-pktrm,Park Street,42.356395,-71.062424,1,\n" +
+			"70075,Park Street,42.35639457,-71.0624242,0,place-pktrm\n",
+		"trips.txt": "route_id,service_id,trip_id,trip_headsign,direction_id,shape_id\n" +
+			"Red,FallWeekday,60392455,Alewife,1,931_0010\n",
+		"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+			"60392455,05:16:00,05:16:00,70075,120\n" +
+			"60392455,25:01:00,25:01:00,70077,130\n",
+		"shapes.txt": "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n" +
+			"931_0010,42.3958,-71.1424,10001\n" +
+			"931_0010,42.3963,-71.1410,10002\n",
+		"calendar.txt": "service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\n" +
+			"FallWeekday,1,1,1,1,1,0,0,20240101,20240331\n",
+	}
+	path := dir + "/gtfs.zip"
+	writeZip(t, path, feed)
+
+	p, err := pipeline.NewETLPipeline("", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		counts, err := p.ImportGTFS(path)
+		if err != nil {
+			t.Fatalf("Import %d failed: %v", i+1, err)
+		}
+		expected := map[string]int{
+			"gtfs_routes": 2, "gtfs_stops": 2, "gtfs_trips": 1, "gtfs_stop_times": 2,
+			"gtfs_shapes": 2, "gtfs_calendar": 1, "gtfs_calendar_dates": 0,
+		}
+		for table, want := range expected {
+			if counts[table] != want {
+				t.Errorf("Import %d: expected %d rows in %s, got %d", i+1, want, table, counts[table])
+			}
+		}
+	}
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var longName string
+	var shortName sql.NullString
+	var routeType int
+	err = db.QueryRow("SELECT route_long_name, route_short_name, route_type FROM gtfs_routes WHERE route_id = 'Red'").
+		Scan(&longName, &shortName, &routeType)
+	if err != nil {
+		t.Fatalf("Failed to query route: %v", err)
+	}
+	if longName != "Red Line" || shortName.Valid || routeType != 1 {
+		t.Errorf("Unexpected route: %s, %v, %d", longName, shortName, routeType)
+	}
+
+	var lat float64
+	var parent string
+	err = db.QueryRow("SELECT stop_lat, parent_station FROM gtfs_stops WHERE stop_id = '70075'").Scan(&lat, &parent)
+	if err != nil {
+		t.Fatalf("Failed to query stop: %v", err)
+	}
+	if lat != 42.35639457 || parent != "place-pktrm" {
+		t.Errorf("Unexpected stop: %f, %s", lat, parent)
+	}
+
+	// Re-import replaces the previous schedule; a bad feed leaves it untouched
+	delete(feed, "calendar.txt")
+	feed["calendar_dates.txt"] = "service_id,date,exception_type\nFallWeekday,20240219,2\n"
+	feed["trips.txt"] = "route_id,service_id,trip_id\nRed,FallWeekday,60392456\n"
+	writeZip(t, path, feed)
+	counts, err := p.ImportGTFS(path)
+	if err != nil {
+		t.Fatalf("Re-import failed: %v", err)
+	}
+	if counts["gtfs_calendar"] != 0 || counts["gtfs_calendar_dates"] != 1 {
+		t.Errorf("Expected calendar replaced by calendar_dates, got %v", counts)
+	}
+
+	delete(feed, "stops.txt")
+	writeZip(t, path, feed)
+	if _, err := p.ImportGTFS(path); err == nil {
+		t.Error("Expected import without stops.txt to fail")
+	}
+
+	var tripID string
+	if err := db.QueryRow("SELECT trip_id FROM gtfs_trips").Scan(&tripID); err != nil {
+		t.Fatalf("Failed to query trips: %v", err)
+	}
+	if tripID != "60392456" {
+		t.Errorf("Expected trips from the last good import, got %s", tripID)
+	}
+}
+
+// recordingLoader is a second sink that keeps every record it is given
+type recordingLoader struct {
+	records []VehicleRecord
+	batches []int
+	err     error
+}
+
+func (l *recordingLoader) Load(ctx context.Context, records []VehicleRecord) error {
+	l.records = append(l.records, records...)
+	l.batches = append(l.batches, len(records))
+	return l.err
+}
+
+// labelTransformer wraps the default transform and prefixes every label
+type labelTransformer struct {
+	next *pipeline.ETLPipeline
+}
+
+func (t labelTransformer) Transform(ctx context.Context, vehicles []Vehicle) ([]VehicleRecord, error) {
+	records, err := t.next.Transform(vehicles)
+	for i := range records {
+		records[i].Label = "bus-" + records[i].Label
+	}
+	return records, err
+}
+
+// Test pluggable stages - File source, custom transform and fan-out to loaders
+func TestPluggableStages(t *testing.T) {
+	file := t.TempDir() + "/vehicles.json"
+	if err := os.WriteFile(file, syntheticFeed(3), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// The default transform is still reachable for wrapping
+	base, err := pipeline.NewETLPipeline("", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create base pipeline: %v", err)
+	}
+	defer base.Close()
+
+	sink := &recordingLoader{}
+	failing := &recordingLoader{err: errors.New("sink unavailable")}
+	p, err := pipeline.NewETLPipeline("http://unused.invalid", ":memory:",
+		pipeline.WithExtractor(pipeline.FileExtractor{Path: file}),
+		pipeline.WithTransformer(labelTransformer{next: base}),
+		pipeline.WithLoader(failing),
+		pipeline.WithLoader(sink),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	result, err := p.RunContext(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "sink unavailable") {
+		t.Errorf("Expected the failing loader's error, got %v", err)
+	}
+	if result.Extracted != 3 || result.Transformed != 3 {
+		t.Errorf("Expected 3 extracted and transformed, got %+v", result)
+	}
+
+	// Every loader gets the batch even though one failed
+	if len(sink.records) != 3 || len(failing.records) != 3 {
+		t.Errorf("Expected both extra loaders to receive 3 records, got %d and %d",
+			len(sink.records), len(failing.records))
+	}
+	if sink.records[0].Label != "bus-0" {
+		t.Errorf("Expected custom transform to be applied, got label %s", sink.records[0].Label)
+	}
+
+	// The run failed, so SQLite is rolled back
+	if count, err := p.CountVehicles(); err != nil || count != 0 {
+		t.Errorf("Expected a failed run to store nothing, got %d vehicles, %v", count, err)
+	}
+
+	// Once every loader succeeds the run is stored
+	failing.err = nil
+	if err := p.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	vehicle, err := p.GetVehicle("y1")
+	if err != nil {
+		t.Fatalf("Expected SQLite to be loaded: %v", err)
+	}
+	if vehicle.Label != "bus-1" {
+		t.Errorf("Expected stored label bus-1, got %s", vehicle.Label)
+	}
+}
+
+// Test RunContext - Cancellation aborts requests, retry waits and loads
+func TestRunContextCancellation(t *testing.T) {
+	t.Run("in-flight request", func(t *testing.T) {
+		var requests int32
+		arrived := make(chan struct{}, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			arrived <- struct{}{}
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		p, err := pipeline.NewETLPipeline(server.URL, ":memory:")
+		if err != nil {
+			t.Fatalf("Failed to create p: %v", err)
+		}
+		defer p.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-arrived
+			cancel()
+		}()
+
+		_, err = p.RunContext(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		if pipeline.IsTransient(err) {
+			t.Error("Expected cancellation not to be reported as transient")
+		}
+		if got := atomic.LoadInt32(&requests); got != 1 {
+			t.Errorf("Expected cancelled request not to be retried, got %d requests", got)
+		}
+	})
+
+	t.Run("retry backoff", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		clock := newFakeClock(time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC))
+		p, err := pipeline.NewETLPipeline(server.URL, ":memory:", pipeline.WithClock(clock))
+		if err != nil {
+			t.Fatalf("Failed to create p: %v", err)
+		}
+		defer p.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			_, err := p.RunContext(ctx)
+			done <- err
+		}()
+
+		// Cancel while the pipeline sleeps before its first retry
+		clock.next(t)
+		cancel()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("RunContext did not return after cancellation")
+		}
+	})
+
+	t.Run("later page fails", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("page[offset]") != "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(syntheticFeed(1500))
+		}))
+		defer server.Close()
+
+		p, err := pipeline.NewETLPipeline(server.URL+"/vehicles", ":memory:")
+		if err != nil {
+			t.Fatalf("Failed to create p: %v", err)
+		}
+		defer p.Close()
+
+		// The first batch of 1000 was loaded before page 2 failed
+		result, err := p.RunContext(context.Background())
+		if err == nil || result.Loaded != 1000 {
+			t.Errorf("Expected the run to fail after one batch, got %+v, %v", result, err)
+		}
+		if count, err := p.CountVehicles(); err != nil || count != 0 {
+			t.Errorf("Expected the failed run to be rolled back, got %d vehicles, %v", count, err)
+		}
+	})
+
+	t.Run("load rolled back", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(bytes.Replace(syntheticFeed(10), []byte(`"next":"/vehicles?page[offset]=2"`), nil, 1))
+		}))
+		defer server.Close()
+
+		// Cancel between transform and load, as a signal arriving mid-run would
+		ctx, cancel := context.WithCancel(context.Background())
+		base, err := pipeline.NewETLPipeline("", ":memory:")
+		if err != nil {
+			t.Fatalf("Failed to create base pipeline: %v", err)
+		}
+		defer base.Close()
+
+		sink := &recordingLoader{}
+		p, err := pipeline.NewETLPipeline(server.URL, ":memory:",
+			pipeline.WithTransformer(cancellingTransformer{next: base, cancel: cancel}),
+			pipeline.WithLoader(sink),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create p: %v", err)
+		}
+		defer p.Close()
+
+		if _, err := p.RunContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		count, err := p.CountVehicles()
+		if err != nil {
+			t.Fatalf("CountVehicles failed: %v", err)
+		}
+		if count != 0 {
+			t.Errorf("Expected no vehicles after a cancelled load, got %d", count)
+		}
+
+		// The ETag was not saved, so the next run fetches and loads again
+		result, err := p.RunContext(context.Background())
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if result.NotModified || result.Loaded != 10 {
+			t.Errorf("Expected a full reload after cancellation, got %+v", result)
+		}
+	})
+}
+
+// cancellingTransformer cancels the run's context once it has transformed
+type cancellingTransformer struct {
+	next   *pipeline.ETLPipeline
+	cancel context.CancelFunc
+}
+
+func (t cancellingTransformer) Transform(ctx context.Context, vehicles []Vehicle) ([]VehicleRecord, error) {
+	defer t.cancel()
+	return t.next.Transform(vehicles)
+}
+
+// Test ingestion ledger - Every run is recorded and loaded rows carry its id
+func TestIngestionRunLedger(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.Header().Set("ETag", `"v1"`)
+			// The second vehicle has no label and is skipped by Transform
+			w.Write([]byte(`{"data":[` +
+				`{"id":"v1","attributes":{"updated_at":"2024-01-15T10:30:00-05:00","label":"1001","latitude":42.36,"longitude":-71.05}},` +
+				`{"id":"v2","attributes":{"updated_at":"2024-01-15T10:30:00-05:00","latitude":42.36,"longitude":-71.05}}]}`))
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}))
+	defer server.Close()
+
+	p, err := pipeline.NewETLPipeline(server.URL, ":memory:", pipeline.WithRetryPolicy(pipeline.RetryPolicy{}))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	first, err := p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("First run failed: %v", err)
+	}
+	if first.RunID == 0 || first.Skipped != 1 || first.Loaded != 1 {
+		t.Errorf("Unexpected first run result: %+v", first)
+	}
+	if err := p.Run(); err == nil {
+		t.Error("Expected second run to fail on 502")
+	}
+	if third, err := p.RunContext(context.Background()); err != nil || !third.NotModified {
+		t.Errorf("Expected third run to be not modified, got %+v, %v", third, err)
+	}
+
+	runs, err := p.GetRecentRuns(10)
+	if err != nil {
+		t.Fatalf("GetRecentRuns failed: %v", err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("Expected 3 runs, got %d", len(runs))
+	}
+
+	// Newest first
+	notModified, failed, loaded := runs[0], runs[1], runs[2]
+	if loaded.ID != first.RunID || loaded.Extracted != 2 || loaded.Transformed != 1 || loaded.Skipped != 1 ||
+		loaded.Loaded != 1 || loaded.HTTPStatus != http.StatusOK || loaded.Error != "" {
+		t.Errorf("Unexpected successful run: %+v", loaded)
+	}
+	if loaded.SourceURL != server.URL || loaded.FinishedAt == nil || loaded.FinishedAt.Before(loaded.StartedAt) {
+		t.Errorf("Unexpected source or timing: %+v", loaded)
+	}
+	if failed.HTTPStatus != http.StatusBadGateway || !strings.Contains(failed.Error, "502") || failed.Loaded != 0 {
+		t.Errorf("Unexpected failed run: %+v", failed)
+	}
+	if !notModified.NotModified || notModified.HTTPStatus != http.StatusNotModified {
+		t.Errorf("Unexpected not-modified run: %+v", notModified)
+	}
+
+	vehicle, err := p.GetVehicle("v1")
+	if err != nil {
+		t.Fatalf("GetVehicle failed: %v", err)
+	}
+	history, err := p.GetVehicleHistory("v1")
+	if err != nil {
+		t.Fatalf("GetVehicleHistory failed: %v", err)
+	}
+	if vehicle.RunID != first.RunID || len(history) != 1 || history[0].RunID != first.RunID {
+		t.Errorf("Expected rows to carry run id %d, got %d and %+v", first.RunID, vehicle.RunID, history)
+	}
+
+	if limited, err := p.GetRecentRuns(1); err != nil || len(limited) != 1 || limited[0].ID != notModified.ID {
+		t.Errorf("Expected limit to return the newest run, got %+v, %v", limited, err)
+	}
+}
+
+// Test migrations - A database from before schema_migrations is upgraded in place
+func TestSchemaMigrations(t *testing.T) {
+	dbPath := t.TempDir() + "/legacy.db"
+
+	// The original schema, with a row written by an old build
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE vehicles (
+			id TEXT PRIMARY KEY,
+			label TEXT NOT NULL,
+			latitude REAL NOT NULL,
+			longitude REAL NOT NULL,
+			speed REAL NOT NULL,
+			direction_id INTEGER NOT NULL,
+			current_status TEXT NOT NULL,
+			occupancy_status TEXT NOT NULL,
+			bearing INTEGER NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			ingested_at TIMESTAMP NOT NULL
+		);
+		INSERT INTO vehicles VALUES ('old', '0001', 42.3, -71.0, 5, 0, 'STOPPED_AT', 'UNKNOWN', 90,
+			'2024-01-15 15:00:00+00:00', '2024-01-15 15:00:01+00:00');
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	p, err := pipeline.NewETLPipeline("", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to migrate legacy database: %v", err)
+	}
+	statuses, err := p.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	for _, m := range statuses {
+		if !m.Applied || m.AppliedAt == nil {
+			t.Errorf("Expected migration %d (%s) to be applied", m.Version, m.Name)
+		}
+	}
+
+	// The old row survives and new columns are usable
+	old, err := p.GetVehicle("old")
+	if err != nil || old.Label != "0001" || old.RouteID != "" {
+		t.Errorf("Expected legacy row to survive, got %+v, %v", old, err)
+	}
+	records := []pipeline.VehicleRecord{{
+		ID: "new", Label: "1001", Latitude: 42.36, Longitude: -71.05, RouteID: "Red", RunID: 1,
+		UpdatedAt: time.Now(), IngestedAt: time.Now(),
+	}}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Load into migrated database failed: %v", err)
+	}
+	if applied, err := p.MigrateUp(); err != nil || applied != 0 {
+		t.Errorf("Expected MigrateUp to be a no-op, got %d, %v", applied, err)
+	}
+	p.Close()
+
+	// Roll everything back without auto-migrating first
+	p, err = pipeline.NewETLPipeline("", dbPath, pipeline.WithAutoMigrate(false))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer p.Close()
+	for want := len(statuses); want > 0; want-- {
+		version, err := p.MigrateDown()
+		if err != nil {
+			t.Fatalf("MigrateDown failed: %v", err)
+		}
+		if version != want {
+			t.Errorf("Expected to revert migration %d, reverted %d", want, version)
+		}
+	}
+	if version, err := p.MigrateDown(); err != nil || version != 0 {
+		t.Errorf("Expected nothing left to revert, got %d, %v", version, err)
+	}
+	if _, err := p.GetVehicle("new"); err == nil {
+		t.Error("Expected vehicles table to be dropped")
+	}
+
+	if applied, err := p.MigrateUp(); err != nil || applied != len(statuses) {
+		t.Fatalf("Expected %d migrations re-applied, got %d, %v", len(statuses), applied, err)
+	}
+	if err := p.Load(records); err != nil {
+		t.Errorf("Load after re-applying migrations failed: %v", err)
+	}
+
+	// A database migrated by a newer build is refused rather than guessed at
+	db, err = sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (999, 'future', CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatalf("Failed to record future migration: %v", err)
+	}
+	if _, err := pipeline.NewETLPipeline("", dbPath); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected newer schema to be refused, got %v", err)
+	}
+}
+
+// Test validation - Vehicles failing a rule are quarantined and counted per rule
+func TestValidationQuarantine(t *testing.T) {
+	now := time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC)
+	vehicle := func(id, updatedAt string, lat, lon float64, extra string) string {
+		return fmt.Sprintf(`{"id":%q,"attributes":{"label":"1","updated_at":%q,"latitude":%g,"longitude":%g%s}}`,
+			id, updatedAt, lat, lon, extra)
+	}
+	fresh := "2024-01-15T10:29:00-05:00"
+	feed := `{"data":[` + strings.Join([]string{
+		vehicle("ok", fresh, 42.36, -71.05, `,"speed":12.5,"bearing":359,"direction_id":1`),
+		vehicle("no-speed", fresh, 42.36, -71.05, `,"speed":null,"bearing":null`),
+		vehicle("null-island", fresh, 0, 0, `,"revenue":"REVENUE"`),
+		vehicle("too-fast", fresh, 42.36, -71.05, `,"speed":120`),
+		vehicle("reversing", fresh, 42.36, -71.05, `,"speed":-1`),
+		vehicle("spinning", fresh, 42.36, -71.05, `,"bearing":360`),
+		vehicle("sideways", fresh, 42.36, -71.05, `,"direction_id":2`),
+		vehicle("future", "2024-01-15T11:00:00-05:00", 42.36, -71.05, ""),
+		vehicle("stale", "2024-01-13T10:30:00-05:00", 42.36, -71.05, ""),
+		vehicle("garbled", "yesterday", 42.36, -71.05, ""),
+	}, ",") + `]}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(feed))
+	}))
+	defer server.Close()
+
+	dbPath := t.TempDir() + "/etl.db"
+	p, err := pipeline.NewETLPipeline(server.URL, dbPath,
+		pipeline.WithClock(newFakeClock(now)),
+		pipeline.WithValidation(pipeline.DefaultValidationRules),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	result, err := p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	wantRules := map[string]int{
+		"area": 1, "speed": 2, "bearing": 1, "direction": 1, "future": 1, "stale": 1, "timestamp": 1,
+	}
+	if result.Extracted != 10 || result.Rejected != 8 || result.Loaded != 2 || result.Skipped != 0 {
+		t.Errorf("Unexpected run result: %+v", result)
+	}
+	if !reflect.DeepEqual(result.RejectedByRule, wantRules) {
+		t.Errorf("Expected rejections %v, got %v", wantRules, result.RejectedByRule)
+	}
+
+	vehicles, err := p.GetVehicles()
+	if err != nil {
+		t.Fatalf("GetVehicles failed: %v", err)
+	}
+	if len(vehicles) != 2 || vehicles[0].ID != "no-speed" || vehicles[1].ID != "ok" {
+		t.Errorf("Expected only valid vehicles to be loaded, got %+v", vehicles)
+	}
+
+	runs, err := p.GetRecentRuns(1)
+	if err != nil || len(runs) != 1 || runs[0].Rejected != 8 {
+		t.Errorf("Expected ledger to record 8 rejections, got %+v, %v", runs, err)
+	}
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var runID int64
+	var rule, detail, raw string
+	err = db.QueryRow("SELECT run_id, rule, detail, raw FROM rejected_records WHERE vehicle_id = 'null-island'").
+		Scan(&runID, &rule, &detail, &raw)
+	if err != nil {
+		t.Fatalf("Failed to query rejected record: %v", err)
+	}
+	if runID != result.RunID || rule != "area" || detail == "" {
+		t.Errorf("Unexpected rejected record: run %d, rule %q, detail %q", runID, rule, detail)
+	}
+	var rejected Vehicle
+	if err := json.Unmarshal([]byte(raw), &rejected); err != nil || rejected.ID != "null-island" {
+		t.Errorf("Expected raw JSON of the vehicle, got %s (%v)", raw, err)
+	}
+	if !strings.Contains(raw, `"revenue":"REVENUE"`) {
+		t.Errorf("Expected raw JSON as the feed sent it, including unknown attributes, got %s", raw)
+	}
+
+	// LoadFrom goes through the same rules
+	loaded, err := p.LoadFrom(strings.NewReader(feed))
+	if err != nil {
+		t.Fatalf("LoadFrom failed: %v", err)
+	}
+	if loaded.Rejected != 8 || !reflect.DeepEqual(loaded.RejectedByRule, wantRules) {
+		t.Errorf("Expected LoadFrom to reject 8 vehicles, got %+v", loaded)
+	}
+}
+
+// Test stale vehicles - Vehicles missing from a snapshot or too old drop out of queries
+func TestStaleVehicles(t *testing.T) {
+	now := time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC)
+	vehicle := func(id string, speed float64, updatedAt string) string {
+		return fmt.Sprintf(`{"id":%q,"attributes":{"label":%q,"speed":%g,"updated_at":%q,"latitude":42.36,"longitude":-71.05}}`,
+			id, id, speed, updatedAt)
+	}
+	fresh := "2024-01-15T10:29:00-05:00"
+	later := "2024-01-15T11:20:00-05:00"
+	snapshots := []string{
+		vehicle("a", 10, fresh) + "," + vehicle("b", 20, fresh) + "," + vehicle("ghost", 99, fresh),
+		vehicle("a", 10, fresh) + "," + vehicle("b", 20, fresh),
+		vehicle("a", 10, later) + "," + vehicle("b", 20, fresh) + "," + vehicle("ghost", 99, later),
+	}
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1)) - 1
+		w.Write([]byte(`{"data":[` + snapshots[n%len(snapshots)] + `]}`))
+	}))
+	defer server.Close()
+
+	dbPath := t.TempDir() + "/etl.db"
+	p, err := pipeline.NewETLPipeline(server.URL, dbPath, pipeline.WithClock(newFakeClock(now)))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	ids := func(records []VehicleRecord) []string {
+		var out []string
+		for _, r := range records {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+
+	if err := p.Run(); err != nil {
+		t.Fatalf("First run failed: %v", err)
+	}
+	result, err := p.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if result.Retired != 1 {
+		t.Errorf("Expected the missing vehicle to be retired, got %+v", result)
+	}
+
+	vehicles, _ := p.GetVehicles()
+	top, _ := p.GetTop10FastestVehicles()
+	stats, err := p.GetSummaryStats()
+	if err != nil {
+		t.Fatalf("GetSummaryStats failed: %v", err)
+	}
+	if got := ids(vehicles); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Expected only active vehicles, got %v", got)
+	}
+	if len(top) != 2 || top[0].ID != "b" || stats.TotalVehicles != 2 || stats.MaxSpeed != 20 {
+		t.Errorf("Expected queries to ignore the ghost, got top %v and stats %+v", ids(top), stats)
+	}
+	if _, err := p.GetVehicle("ghost"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected stale vehicle lookup to fail, got %v", err)
+	}
+
+	// The stale row is kept and visible on request
+	all, err := pipeline.NewETLPipeline(server.URL, dbPath, pipeline.WithIncludeStale(true))
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer all.Close()
+	ghost, err := all.GetVehicle("ghost")
+	if err != nil || !ghost.Stale {
+		t.Errorf("Expected stale ghost with WithIncludeStale, got %+v, %v", ghost, err)
+	}
+	if count, _ := all.CountVehicles(); count != 3 {
+		t.Errorf("Expected 3 vehicles including stale, got %d", count)
+	}
+
+	// A vehicle that comes back is active again
+	if err := p.Run(); err != nil {
+		t.Fatalf("Third run failed: %v", err)
+	}
+	if count, _ := p.CountVehicles(); count != 3 {
+		t.Errorf("Expected the ghost to be active again, got %d vehicles", count)
+	}
+
+	// A filtered run only sees part of the fleet, so absence means nothing
+	filtered, err := pipeline.NewETLPipeline(server.URL, dbPath,
+		pipeline.WithClock(newFakeClock(now)),
+		pipeline.WithExtractOptions(pipeline.ExtractOptions{Filter: map[string]string{"route": "Red"}}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer filtered.Close()
+	if result, err := filtered.RunContext(context.Background()); err != nil || result.Retired != 0 {
+		t.Errorf("Expected a filtered run to retire nothing, got %+v, %v", result, err)
+	}
+
+	// MaxAge retires vehicles that stopped updating, and Delete removes them
+	aging, err := pipeline.NewETLPipeline(server.URL, dbPath,
+		pipeline.WithClock(newFakeClock(now.Add(time.Hour))),
+		pipeline.WithStalePolicy(pipeline.StalePolicy{MaxAge: time.Hour, Delete: true}),
+		pipeline.WithIncludeStale(true),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer aging.Close()
+	atomic.StoreInt32(&requests, 2)
+	if result, err := aging.RunContext(context.Background()); err != nil || result.Retired != 1 {
+		t.Errorf("Expected the outdated vehicle to be retired, got %+v, %v", result, err)
+	}
+	remaining, _ := aging.GetVehicles()
+	if got := ids(remaining); !reflect.DeepEqual(got, []string{"a", "ghost"}) {
+		t.Errorf("Expected the outdated vehicle to be deleted, got %v", got)
+	}
+	if history, _ := aging.GetVehicleHistory("b"); len(history) != 1 {
+		t.Errorf("Expected deleted vehicle to keep its history, got %d positions", len(history))
+	}
+}
+
+// Test Run - A filter in the API URL makes the snapshot partial
+func TestStaleFilterInAPIURL(t *testing.T) {
+	now := time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"id":"red-1","attributes":{"label":"1801",` +
+			`"updated_at":"2024-01-15T10:29:00-05:00","latitude":42.36,"longitude":-71.05}}]}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		retired int
+	}{
+		{"unfiltered", "/vehicles", 1},
+		{"filtered", "/vehicles?filter[route]=Red", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := pipeline.NewETLPipeline(server.URL+tt.path, ":memory:", pipeline.WithClock(newFakeClock(now)))
+			if err != nil {
+				t.Fatalf("Failed to create p: %v", err)
+			}
+			defer p.Close()
+			err = p.Load([]VehicleRecord{{ID: "orange-1", RouteID: "Orange", UpdatedAt: now, IngestedAt: now}})
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			result, err := p.RunContext(context.Background())
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if result.Retired != tt.retired {
+				t.Errorf("Expected %d retired, got %+v", tt.retired, result)
+			}
+		})
+	}
+}
+
+// Test nullable readings - A missing speed or bearing is unknown, not 0
+func TestNullSpeedAndBearing(t *testing.T) {
+	p, err := pipeline.NewETLPipeline("http://test", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to create p: %v", err)
+	}
+	defer p.Close()
+
+	vehicle := func(id string, speed *float64, bearing *int) VehicleRecord {
+		return VehicleRecord{
+			ID: id, Label: id, Latitude: 42.3601, Longitude: -71.0589,
+			Speed: speed, Bearing: bearing, CurrentStatus: "IN_TRANSIT_TO", OccupancyStatus: "UNKNOWN",
+			UpdatedAt: time.Now(), IngestedAt: time.Now(),
+		}
+	}
+	records := []VehicleRecord{
+		vehicle("moving", ptr(10.0), ptr(90)),
+		vehicle("stopped", ptr(0.0), ptr(0)),
+		vehicle("silent", nil, nil),
+		vehicle("no-bearing", ptr(20.0), nil),
+	}
+	if err := p.Load(records); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	silent, err := p.GetVehicle("silent")
+	if err != nil {
+		t.Fatalf("GetVehicle failed: %v", err)
+	}
+	if silent.Speed != nil || silent.Bearing != nil {
+		t.Errorf("Expected nil speed and bearing, got %+v", silent)
+	}
+	if speed, err := p.GetVehicleSpeed("silent"); err != nil || speed != nil {
+		t.Errorf("Expected unknown speed, got %v, %v", speed, err)
+	}
+
+	stats, err := p.GetSummaryStats()
+	if err != nil {
+		t.Fatalf("GetSummaryStats failed: %v", err)
+	}
+	if stats.TotalVehicles != 4 || stats.MovingVehicles != 2 || stats.StationaryVehicles != 1 {
+		t.Errorf("Expected 2 moving and 1 stationary of 4, got %+v", stats)
+	}
+	if stats.MissingSpeed != 1 || stats.MissingBearing != 2 {
+		t.Errorf("Expected 1 missing speed and 2 missing bearings, got %d and %d", stats.MissingSpeed, stats.MissingBearing)
+	}
+	if stats.AverageSpeed != 10 || stats.MinSpeed != 0 {
+		t.Errorf("Expected speed stats over reported speeds only, got %+v", stats)
+	}
+	if math.Abs(stats.PercentMoving-200.0/3) > 1e-9 {
+		t.Errorf("Expected 2 of 3 reporting vehicles moving, got %.2f%%", stats.PercentMoving)
+	}
+
+	// Only the vehicle actually pointing north is counted there
+	summary, err := p.GetBearingSummary()
+	if err != nil {
+		t.Fatalf("GetBearingSummary failed: %v", err)
+	}
+	if summary[0].Direction != "North" || summary[0].Count != 1 || summary[2].Count != 1 {
+		t.Errorf("Expected one vehicle north and one east, got %+v", summary)
+	}
+
+	top, err := p.GetTop10FastestVehicles()
+	if err != nil {
+		t.Fatalf("GetTop10FastestVehicles failed: %v", err)
+	}
+	if len(top) != 3 || top[0].ID != "no-bearing" {
+		t.Errorf("Expected vehicles without a speed to be left out, got %+v", top)
+	}
+
+	// Unknown readings are null in JSON and empty in CSV
+	fc, err := p.GetGeoJSON(pipeline.VehicleFilter{})
+	if err != nil {
+		t.Fatalf("GetGeoJSON failed: %v", err)
+	}
+	body, _ := json.Marshal(fc)
+	if !strings.Contains(string(body), `"speed":null,"bearing":null`) {
+		t.Errorf("Expected null speed and bearing in GeoJSON, got %s", body)
+	}
+	var buf bytes.Buffer
+	if err := output.Write(&buf, output.CSV, []VehicleRecord{*silent}); err != nil {
+		t.Fatalf("CSV output failed: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 2 || rows[1][4] != "" || rows[1][8] != "" {
+		t.Errorf("Expected empty speed and bearing cells, got %v, %v", rows, err)
+	}
+}
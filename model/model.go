@@ -1,45 +1,250 @@
 package model
 
 import (
+	"encoding/json"
 	"time"
 )
 
 // MBTA API Response structures
 type VehicleResponse struct {
-	Data []Vehicle `json:"data"`
+	Data     []Vehicle         `json:"data"`
+	Included []json.RawMessage `json:"included,omitempty"`
+	Links    *Links            `json:"links,omitempty"`
+}
+
+// JSON:API pagination links
+type Links struct {
+	Self  string `json:"self,omitempty"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
 }
 
 type Vehicle struct {
-	ID         string     `json:"id"`
-	Type       string     `json:"type"`
-	Attributes Attributes `json:"attributes"`
+	ID            string        `json:"id"`
+	Type          string        `json:"type"`
+	Attributes    Attributes    `json:"attributes"`
+	Relationships Relationships `json:"relationships"`
+
+	// Raw is the element of data[] the vehicle was decoded from, nil for
+	// vehicles that did not come from a JSON:API document
+	Raw json.RawMessage `json:"-"`
+}
+
+// JSON:API links from a vehicle to its route, trip and stop
+type Relationships struct {
+	Route Relationship `json:"route"`
+	Trip  Relationship `json:"trip"`
+	Stop  Relationship `json:"stop"`
+}
+
+type Relationship struct {
+	Data *ResourceIdentifier `json:"data"`
+}
+
+type ResourceIdentifier struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// ID returns the related resource id, or "" if the relationship is empty
+func (r Relationship) ID() string {
+	if r.Data == nil {
+		return ""
+	}
+	return r.Data.ID
 }
 
 type Attributes struct {
-	UpdatedAt           string    `json:"updated_at"`
-	Speed               *float64  `json:"speed"`
-	RevenueStatus       string    `json:"revenue_status"`
-	OccupancyStatus     string    `json:"occupancy_status"`
-	Longitude           float64   `json:"longitude"`
-	Latitude            float64   `json:"latitude"`
-	Label               string    `json:"label"`
-	DirectionID         int       `json:"direction_id"`
-	CurrentStopSequence *int      `json:"current_stop_sequence"`
-	CurrentStatus       string    `json:"current_status"`
-	Bearing             *int      `json:"bearing"`
+	UpdatedAt           string   `json:"updated_at"`
+	Speed               *float64 `json:"speed"`
+	RevenueStatus       string   `json:"revenue_status"`
+	OccupancyStatus     string   `json:"occupancy_status"`
+	Longitude           float64  `json:"longitude"`
+	Latitude            float64  `json:"latitude"`
+	Label               string   `json:"label"`
+	DirectionID         int      `json:"direction_id"`
+	CurrentStopSequence *int     `json:"current_stop_sequence"`
+	CurrentStatus       string   `json:"current_status"`
+	Bearing             *int     `json:"bearing"`
+}
+
+// MBTA /routes response structures
+type RouteResponse struct {
+	Data []Route `json:"data"`
+}
+
+type Route struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Attributes RouteAttributes `json:"attributes"`
+}
+
+type RouteAttributes struct {
+	LongName  string `json:"long_name"`
+	ShortName string `json:"short_name"`
+	Type      int    `json:"type"`
+	Color     string `json:"color"`
+	TextColor string `json:"text_color"`
+}
+
+// GTFS route types used by the MBTA
+const (
+	RouteTypeLightRail    = 0
+	RouteTypeSubway       = 1
+	RouteTypeCommuterRail = 2
+	RouteTypeBus          = 3
+	RouteTypeFerry        = 4
+
+	// RouteTypeUnknown marks vehicles whose route is missing or not synced
+	RouteTypeUnknown = -1
+)
+
+// RouteTypeName returns a human readable name for a GTFS route type
+func RouteTypeName(routeType int) string {
+	switch routeType {
+	case RouteTypeLightRail:
+		return "Light Rail"
+	case RouteTypeSubway:
+		return "Subway"
+	case RouteTypeCommuterRail:
+		return "Commuter Rail"
+	case RouteTypeBus:
+		return "Bus"
+	case RouteTypeFerry:
+		return "Ferry"
+	default:
+		return "Unknown"
+	}
 }
 
 // Normalized database schema
 type VehicleRecord struct {
-	ID              string
-	Label           string
-	Latitude        float64
-	Longitude       float64
-	Speed           float64
-	DirectionID     int
-	CurrentStatus   string
-	OccupancyStatus string
-	Bearing         int
-	UpdatedAt       time.Time
-	IngestedAt      time.Time
+	ID              string    `json:"id"`
+	Label           string    `json:"label"`
+	Latitude        float64   `json:"latitude"`
+	Longitude       float64   `json:"longitude"`
+	Speed           *float64  `json:"speed"` // m/s, nil if the vehicle did not report one
+	DirectionID     int       `json:"direction_id"`
+	CurrentStatus   string    `json:"current_status"`
+	OccupancyStatus string    `json:"occupancy_status"`
+	Bearing         *int      `json:"bearing"` // nil if the vehicle did not report one
+	RouteID         string    `json:"route_id"`
+	TripID          string    `json:"trip_id"`
+	StopID          string    `json:"stop_id"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	IngestedAt      time.Time `json:"ingested_at"`
+	RunID           int64     `json:"run_id"` // ingestion_runs id, 0 if not loaded by a run
+	Stale           bool      `json:"stale"`  // left service; only returned with WithIncludeStale
+}
+
+// One row of the ingestion_runs ledger
+type IngestionRun struct {
+	ID          int64      `json:"id"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"` // nil while the run is in progress
+	SourceURL   string     `json:"source_url"`
+	Extracted   int        `json:"extracted"`
+	Transformed int        `json:"transformed"`
+	Skipped     int        `json:"skipped"`
+	Rejected    int        `json:"rejected"` // failed validation, see rejected_records
+	Loaded      int        `json:"loaded"`
+	NotModified bool       `json:"not_modified"`
+	HTTPStatus  int        `json:"http_status"` // 0 if no response was received
+	DurationMS  int64      `json:"duration_ms"`
+	Error       string     `json:"error"`
+}
+
+// One schema migration and whether it has been applied
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"` // nil if pending
+}
+
+// Vehicle counts and speeds for a single route
+type RouteStats struct {
+	RouteID       string  `json:"route_id"`
+	LongName      string  `json:"long_name"`
+	RouteType     int     `json:"route_type"`
+	RouteTypeName string  `json:"route_type_name"`
+	Color         string  `json:"color"`
+	Count         int     `json:"count"`
+	AvgSpeed      float64 `json:"avg_speed"`
+	MaxSpeed      float64 `json:"max_speed"`
+}
+
+// Vehicle counts and speeds for a route type (subway, bus, ...)
+type RouteTypeStats struct {
+	RouteType int     `json:"route_type"`
+	Name      string  `json:"name"`
+	Count     int     `json:"count"`
+	AvgSpeed  float64 `json:"avg_speed"`
+	MaxSpeed  float64 `json:"max_speed"`
+}
+
+// Fleet-wide summary statistics; speeds in m/s, percentages in 0-100. Speed
+// figures and moving/stationary counts only cover vehicles reporting a speed.
+type SummaryStats struct {
+	TotalVehicles       int     `json:"total_vehicles"`
+	AverageSpeed        float64 `json:"average_speed"`
+	MaxSpeed            float64 `json:"max_speed"`
+	MinSpeed            float64 `json:"min_speed"`
+	InTransit           int     `json:"in_transit"`
+	Stopped             int     `json:"stopped"`
+	Incoming            int     `json:"incoming"`
+	OccupancyManySeats  float64 `json:"occupancy_many_seats"`
+	OccupancyFewSeats   float64 `json:"occupancy_few_seats"`
+	OccupancyUnknown    float64 `json:"occupancy_unknown"`
+	OutboundVehicles    int     `json:"outbound_vehicles"`
+	InboundVehicles     int     `json:"inbound_vehicles"`
+	MovingVehicles      int     `json:"moving_vehicles"`
+	StationaryVehicles  int     `json:"stationary_vehicles"`
+	PercentMoving       float64 `json:"percent_moving"`
+	MedianSpeed         float64 `json:"median_speed"`
+	Speed90thPercentile float64 `json:"speed_90th_percentile"`
+	Speed95thPercentile float64 `json:"speed_95th_percentile"`
+	MissingSpeed        int     `json:"missing_speed"`   // vehicles with no speed reading
+	MissingBearing      int     `json:"missing_bearing"` // vehicles with no bearing reading
+}
+
+// Number of vehicles heading in one compass direction
+type BearingBucket struct {
+	Direction string `json:"direction"`
+	Count     int    `json:"count"`
+}
+
+// GeoJSON FeatureCollection of vehicle positions (RFC 7946)
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Geometry   Geometry          `json:"geometry"`
+	Properties FeatureProperties `json:"properties"`
+}
+
+// Point geometry; coordinates are [longitude, latitude]
+type Geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// Vehicle attributes carried on each feature
+type FeatureProperties struct {
+	Label           string    `json:"label"`
+	Speed           *float64  `json:"speed"`
+	Bearing         *int      `json:"bearing"`
+	DirectionID     int       `json:"direction_id"`
+	CurrentStatus   string    `json:"current_status"`
+	OccupancyStatus string    `json:"occupancy_status"`
+	RouteID         string    `json:"route_id"`
+	TripID          string    `json:"trip_id"`
+	StopID          string    `json:"stop_id"`
+	UpdatedAt       time.Time `json:"updated_at"`
 }
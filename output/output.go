@@ -0,0 +1,177 @@
+// Package output encodes query results in machine-readable formats
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format selects how query results are written
+type Format string
+
+const (
+	Table  Format = "table"
+	JSON   Format = "json"
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+// ParseFormat validates a -format flag value
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case Table, JSON, CSV, NDJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown format %q (expected table, json, csv or ndjson)", s)
+	}
+}
+
+// Write encodes v, a struct or a slice of structs, in a machine-readable
+// format. Field names come from the structs' json tags so every format uses
+// the same stable names. Table output is left to the caller.
+func Write(w io.Writer, format Format, v interface{}) error {
+	switch format {
+	case JSON:
+		// Empty results are an empty array rather than null
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+			v = []struct{}{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case NDJSON:
+		enc := json.NewEncoder(w)
+		for _, row := range rowsOf(v) {
+			if err := enc.Encode(row.Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case CSV:
+		return writeCSV(w, v)
+	default:
+		return fmt.Errorf("format %q is not machine-readable", format)
+	}
+}
+
+// rowsOf returns the elements of a slice, or v itself as a single row
+func rowsOf(v interface{}) []reflect.Value {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []reflect.Value{rv}
+	}
+
+	rows := make([]reflect.Value, rv.Len())
+	for i := range rows {
+		rows[i] = rv.Index(i)
+	}
+	return rows
+}
+
+func writeCSV(w io.Writer, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+
+	rowType := rv.Type()
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		rowType = rowType.Elem()
+	}
+	for rowType.Kind() == reflect.Ptr {
+		rowType = rowType.Elem()
+	}
+	if rowType.Kind() != reflect.Struct {
+		return fmt.Errorf("csv output needs struct rows, got %s", rowType)
+	}
+
+	fields, header := csvFields(rowType)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(fields))
+	for _, row := range rowsOf(v) {
+		for row.Kind() == reflect.Ptr {
+			row = row.Elem()
+		}
+		for i, idx := range fields {
+			record[i] = formatValue(row.Field(idx))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvFields returns the exported field indexes and their json names
+func csvFields(t reflect.Type) ([]int, []string) {
+	var fields []int
+	var header []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		fields = append(fields, i)
+		header = append(header, name)
+	}
+	return fields, header
+}
+
+// formatValue renders a single CSV cell; nil pointers become empty cells
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return fmt.Sprint(v.Interface())
+		}
+		return string(b)
+	}
+}
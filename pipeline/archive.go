@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveTimeFormat sorts lexically in time order
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+// WithArchiveDir saves every raw vehicles response Extract receives as a
+// gzipped, timestamped file in dir, for later use with Replay
+func WithArchiveDir(dir string) Option {
+	return func(p *ETLPipeline) {
+		p.archiveDir = dir
+	}
+}
+
+// archive passes r to decode, copying the raw bytes to a new archive file
+// with extension ext (plus .gz) when an archive directory is set. The file only appears under its final
+// name once the whole response has been read and decoded.
+func (p *ETLPipeline) archive(r io.Reader, ext string, decode func(io.Reader) error) (err error) {
+	if p.archiveDir == "" {
+		return decode(r)
+	}
+
+	if err := os.MkdirAll(p.archiveDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(p.archiveDir, ".vehicles-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	gz := gzip.NewWriter(tmp)
+	tee := io.TeeReader(r, gz)
+	if err := decode(tee); err != nil {
+		return err
+	}
+	// Keep anything the decoder left unread, e.g. a trailing newline
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write archive file: %w", err)
+	}
+
+	p.mu.Lock()
+	p.archiveSeq++
+	name := fmt.Sprintf("vehicles-%s-%06d%s.gz", p.clock.Now().UTC().Format(archiveTimeFormat), p.archiveSeq, ext)
+	p.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), filepath.Join(p.archiveDir, name)); err != nil {
+		return fmt.Errorf("failed to save archive file: %w", err)
+	}
+	return nil
+}
+
+// Replay loads archived vehicles responses through Transform and Load as if
+// they had just been extracted. path is either a single file or a directory,
+// whose files are replayed in name (and so time) order. JSON:API documents
+// (.json) and GTFS-Realtime feeds (.pb) are replayed, optionally gzipped.
+func (p *ETLPipeline) Replay(path string) (RunResult, error) {
+	return p.ReplayContext(context.Background(), path)
+}
+
+// ReplayContext is Replay with a context; cancelling it stops between files
+// and rolls back the batch in progress. Each file is recorded as a run in the
+// ingestion_runs ledger, with the file path as its source.
+func (p *ETLPipeline) ReplayContext(ctx context.Context, path string) (RunResult, error) {
+	var total RunResult
+	start := p.clock.Now()
+
+	files, err := archiveFiles(path)
+	if err != nil {
+		return total, err
+	}
+
+	for _, file := range files {
+		result, err := p.replayFile(ctx, file)
+		total.Extracted += result.Extracted
+		total.Transformed += result.Transformed
+		total.Skipped += result.Skipped
+		total.Loaded += result.Loaded
+		if err != nil {
+			return total, fmt.Errorf("replay of %s failed: %w", file, err)
+		}
+		log.Printf("Replayed %s: %d records loaded", filepath.Base(file), result.Loaded)
+	}
+
+	total.Duration = p.clock.Now().Sub(start)
+	log.Printf("Replayed %d files: %d records loaded in %v", len(files), total.Loaded, total.Duration)
+	return total, nil
+}
+
+// replayFile loads a single archived response as one ledger run
+func (p *ETLPipeline) replayFile(ctx context.Context, path string) (RunResult, error) {
+	return p.recordRun(ctx, path, func(runID int64) (RunResult, error) {
+		return p.loadFile(ctx, runID, path)
+	})
+}
+
+// loadFile decodes an archived JSON:API or GTFS-RT file and loads it
+func (p *ETLPipeline) loadFile(ctx context.Context, runID int64, path string) (RunResult, error) {
+	r, err := openFile(path)
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer r.Close()
+
+	return p.loadEach(ctx, runID, func(fn func(Vehicle) error) error {
+		if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".pb") {
+			return DecodeGTFSRT(r, fn)
+		}
+		_, err := DecodeVehicles(r, fn)
+		return err
+	})
+}
+
+// openFile opens path for reading, decompressing it if it ends in .gz
+func openFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open gzip: %w", err)
+	}
+	return gzipFile{gz, f}, nil
+}
+
+// gzipFile closes both the gzip reader and the underlying file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// archiveFiles lists the files to replay for path
+func archiveFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	// ReadDir returns entries sorted by name
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch filepath.Ext(strings.TrimSuffix(name, ".gz")) {
+		case ".json", ".pb":
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	return files, nil
+}
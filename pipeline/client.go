@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// HTTP client defaults for MBTA API calls
+const (
+	DefaultTimeout   = 30 * time.Second
+	DefaultUserAgent = "mbta-etl"
+)
+
+// WithAPIKey sends the MBTA x-api-key header, raising the rate limit
+func WithAPIKey(key string) Option {
+	return func(p *ETLPipeline) {
+		p.apiKey = key
+	}
+}
+
+// WithHTTPClient replaces the HTTP client, e.g. to use a custom transport
+func WithHTTPClient(c *http.Client) Option {
+	return func(p *ETLPipeline) {
+		p.client = c
+	}
+}
+
+// WithTimeout sets the per-request timeout (DefaultTimeout unless overridden)
+func WithTimeout(d time.Duration) Option {
+	return func(p *ETLPipeline) {
+		p.timeout = d
+	}
+}
+
+// WithUserAgent overrides DefaultUserAgent
+func WithUserAgent(ua string) Option {
+	return func(p *ETLPipeline) {
+		p.userAgent = ua
+	}
+}
+
+// configureClient applies the timeout to a copy of the configured client so
+// a caller's client is never modified
+func (p *ETLPipeline) configureClient() {
+	if p.client == nil {
+		p.client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if p.timeout > 0 {
+		c := *p.client
+		c.Timeout = p.timeout
+		p.client = &c
+	}
+}
+
+// newRequest builds a GET request carrying the API key and user agent
+func (p *ETLPipeline) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+	if p.apiKey != "" {
+		req.Header.Set("x-api-key", p.apiKey)
+	}
+	return req, nil
+}
@@ -0,0 +1,112 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrNotModified is returned by Extract when the API reports no change since
+// the last successful run
+var ErrNotModified = errors.New("not modified since last run")
+
+// validator holds the HTTP cache validators of a response
+type validator struct {
+	etag         string
+	lastModified string
+}
+
+// fetchConditional GETs url with If-None-Match/If-Modified-Since from the last
+// saved validator and passes the body to decode. New validators are held until
+// commitValidators so an unloaded response is never marked as seen.
+func (p *ETLPipeline) fetchConditional(ctx context.Context, url string, decode func(io.Reader) error) error {
+	saved, err := p.loadValidator(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if saved.etag != "" {
+		header.Set("If-None-Match", saved.etag)
+	}
+	if saved.lastModified != "" {
+		header.Set("If-Modified-Since", saved.lastModified)
+	}
+
+	resp, err := p.get(ctx, url, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return ErrNotModified
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API returned status %d", resp.StatusCode)
+	}
+	if err := decodeBody(url, resp.Body, decode); err != nil {
+		return err
+	}
+
+	fresh := validator{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if fresh.etag != "" || fresh.lastModified != "" {
+		p.holdValidator(url, fresh)
+	}
+
+	return nil
+}
+
+// holdValidator queues v to be saved for url by commitValidators. An empty
+// validator clears the saved one, so url is fetched unconditionally.
+func (p *ETLPipeline) holdValidator(url string, v validator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pendingValidators == nil {
+		p.pendingValidators = make(map[string]validator)
+	}
+	p.pendingValidators[url] = v
+}
+
+// loadValidator returns the saved validator for url, if any
+func (p *ETLPipeline) loadValidator(ctx context.Context, url string) (validator, error) {
+	var v validator
+	err := p.conn(ctx).QueryRowContext(ctx,
+		"SELECT etag, last_modified FROM http_validators WHERE url = ?", url,
+	).Scan(&v.etag, &v.lastModified)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return v, fmt.Errorf("failed to load validator: %w", err)
+	}
+	return v, nil
+}
+
+// commitValidators saves the validators of responses that have been loaded
+func (p *ETLPipeline) commitValidators(ctx context.Context) error {
+	p.mu.Lock()
+	pending := p.pendingValidators
+	p.pendingValidators = nil
+	p.mu.Unlock()
+
+	for url, v := range pending {
+		_, err := p.conn(ctx).ExecContext(ctx, `
+			INSERT INTO http_validators (url, etag, last_modified, updated_at)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(url) DO UPDATE SET
+				etag = excluded.etag,
+				last_modified = excluded.last_modified,
+				updated_at = excluded.updated_at
+		`, url, v.etag, v.lastModified, p.clock.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("failed to save validator: %w", err)
+		}
+	}
+
+	return nil
+}
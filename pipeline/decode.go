@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DecodeVehicles streams a vehicles document from r, calling fn for each
+// element of data[] as it is decoded so the whole array is never held in
+// memory. The returned response carries the document's links and included
+// resources but no Data. An error from fn stops decoding and is returned
+// unchanged.
+func DecodeVehicles(r io.Reader, fn func(Vehicle) error) (*VehicleResponse, error) {
+	dec := json.NewDecoder(r)
+	var doc VehicleResponse
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		key, _ := tok.(string)
+
+		switch key {
+		case "data":
+			if err := decodeData(dec, fn); err != nil {
+				return nil, err
+			}
+		case "included":
+			if err := dec.Decode(&doc.Included); err != nil {
+				return nil, fmt.Errorf("failed to parse JSON: %w", err)
+			}
+		case "links":
+			if err := dec.Decode(&doc.Links); err != nil {
+				return nil, fmt.Errorf("failed to parse JSON: %w", err)
+			}
+		default:
+			// Skip meta, jsonapi and anything else we don't use
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, fmt.Errorf("failed to parse JSON: %w", err)
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// decodeData decodes the data[] array one vehicle at a time
+func decodeData(dec *json.Decoder, fn func(Vehicle) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	if tok == nil {
+		return nil // "data": null
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("failed to parse JSON: data is not an array")
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		v, err := decodeVehicle(raw)
+		if err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+// decodeVehicle parses a single data[] element, keeping its bytes as Raw
+func decodeVehicle(raw json.RawMessage) (Vehicle, error) {
+	var v Vehicle
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return Vehicle{}, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	v.Raw = raw
+	return v, nil
+}
+
+// expectDelim reads the next token and checks it is the given delimiter
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("failed to parse JSON: expected %q, got %v", want, tok)
+	}
+	return nil
+}
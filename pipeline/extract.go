@@ -1,33 +1,214 @@
 package pipeline
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
-// Extract: Fetch data from MBTA API
+// ExtractOptions are JSON:API query parameters added to the vehicles request
+type ExtractOptions struct {
+	// Filter adds filter[key]=value, e.g. {"route": "Red"}
+	Filter map[string]string
+	// Fields adds sparse fieldsets, e.g. {"vehicle": {"label", "latitude"}}.
+	// The vehicle fields Load stores are always requested as well.
+	Fields map[string][]string
+	// Include requests related resources, e.g. {"route", "trip"}
+	Include []string
+	// PageLimit sets page[limit]; 0 leaves paging to the API
+	PageLimit int
+}
+
+// WithExtractOptions sets the query parameters used by Extract and Stream
+func WithExtractOptions(opts ExtractOptions) Option {
+	return func(p *ETLPipeline) {
+		p.extractOpts = opts
+	}
+}
+
+// Extract: Fetch data from MBTA API, following links.next across pages
+//
+// An unpaged response is requested conditionally using the validators saved
+// by the last successful Run; if the API reports it unchanged Extract returns
+// ErrNotModified.
 func (p *ETLPipeline) Extract() (*VehicleResponse, error) {
-	resp, err := http.Get(p.apiURL)
+	return p.ExtractContext(context.Background())
+}
+
+// ExtractContext is Extract with a context that cancels its requests
+func (p *ETLPipeline) ExtractContext(ctx context.Context) (*VehicleResponse, error) {
+	var merged VehicleResponse
+	included, err := p.extract(ctx, func(v Vehicle) error {
+		merged.Data = append(merged.Data, v)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	merged.Included = included
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d", resp.StatusCode)
+	return &merged, nil
+}
+
+// ExtractEach is Extract without buffering: fn is called for each vehicle as
+// it is decoded from the response body. An error from fn stops the extract.
+func (p *ETLPipeline) ExtractEach(fn func(Vehicle) error) error {
+	return p.ExtractEachContext(context.Background(), fn)
+}
+
+// ExtractEachContext is ExtractEach with a context that cancels its requests
+func (p *ETLPipeline) ExtractEachContext(ctx context.Context, fn func(Vehicle) error) error {
+	_, err := p.extract(ctx, fn)
+	return err
+}
+
+// extract streams every page's vehicles to fn and returns the included
+// resources of all pages
+func (p *ETLPipeline) extract(ctx context.Context, fn func(Vehicle) error) ([]json.RawMessage, error) {
+	if p.source == SourceGTFSRT {
+		return nil, p.extractGTFSRT(ctx, fn)
+	}
+
+	first, err := p.requestURL()
+	if err != nil {
+		return nil, err
+	}
+	next := first
+
+	var included []json.RawMessage
+	seen := make(map[string]bool)
+	for next != "" {
+		if seen[next] {
+			return nil, fmt.Errorf("pagination loop at %s", next)
+		}
+		seen[next] = true
+
+		var page *VehicleResponse
+		decode := func(r io.Reader) error {
+			return p.archive(r, ".json", func(r io.Reader) (err error) {
+				page, err = DecodeVehicles(r, fn)
+				return err
+			})
+		}
+		if next == first {
+			err = p.fetchConditional(ctx, next, decode)
+		} else {
+			err = p.fetch(ctx, next, nil, decode)
+		}
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, page.Included...)
+
+		current := next
+		next, err = nextPage(next, page.Links)
+		if err != nil {
+			return nil, err
+		}
+		// A 304 for the first page says nothing about the others, so paged
+		// responses are always fetched in full
+		if current == first && next != "" {
+			p.holdValidator(first, validator{})
+		}
+	}
+
+	return included, nil
+}
+
+// requestURL applies the extract options to the configured API URL
+func (p *ETLPipeline) requestURL() (string, error) {
+	u, err := url.Parse(p.apiURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid API URL: %w", err)
+	}
+
+	q := u.Query()
+	for key, value := range p.extractOpts.Filter {
+		q.Set("filter["+key+"]", value)
+	}
+	for resource, fields := range p.extractOpts.Fields {
+		q.Set("fields["+resource+"]", strings.Join(fields, ","))
+	}
+	if len(p.extractOpts.Include) > 0 {
+		q.Set("include", strings.Join(p.extractOpts.Include, ","))
+	}
+	if p.extractOpts.PageLimit > 0 {
+		q.Set("page[limit]", strconv.Itoa(p.extractOpts.PageLimit))
+	}
+	if fields := q.Get("fields[vehicle]"); fields != "" {
+		q.Set("fields[vehicle]", withStoredFields(fields))
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// storedVehicleFields are the vehicle attributes and relationships Load
+// writes. Leaving one out of a sparse fieldset would blank its column.
+var storedVehicleFields = []string{
+	"label", "latitude", "longitude", "speed", "direction_id", "current_status",
+	"occupancy_status", "bearing", "updated_at", "route", "trip", "stop",
+}
+
+// withStoredFields adds any missing storedVehicleFields to a comma-separated
+// fields[vehicle] list
+func withStoredFields(fields string) string {
+	list := strings.Split(fields, ",")
+	have := make(map[string]bool, len(list))
+	for _, f := range list {
+		have[f] = true
+	}
+	for _, f := range storedVehicleFields {
+		if !have[f] {
+			list = append(list, f)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// nextPage resolves links.next against the current page URL
+func nextPage(current string, links *Links) (string, error) {
+	if links == nil || links.Next == "" {
+		return "", nil
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	base, err := url.Parse(current)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return "", err
 	}
+	next, err := base.Parse(links.Next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next link %q: %w", links.Next, err)
+	}
+	return next.String(), nil
+}
 
-	var vehicleResp VehicleResponse
-	if err := json.Unmarshal(body, &vehicleResp); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+// fetchJSON GETs url, with retries, and decodes the JSON body into v
+func (p *ETLPipeline) fetchJSON(ctx context.Context, url string, v interface{}) error {
+	return p.fetch(ctx, url, nil, func(r io.Reader) error {
+		if err := json.NewDecoder(r).Decode(v); err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		return nil
+	})
+}
+
+// fetch GETs url with the extra headers, with retries, and passes the body of
+// a 200 response to decode
+func (p *ETLPipeline) fetch(ctx context.Context, url string, header http.Header, decode func(io.Reader) error) error {
+	resp, err := p.get(ctx, url, header)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	return &vehicleResp, nil
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API returned status %d", resp.StatusCode)
+	}
+	return decodeBody(url, resp.Body, decode)
 }
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"context"
+
+	"github.com/notLeoHirano/mbta-etl/model"
+)
+
+// NewFeatureCollection converts vehicle records into GeoJSON Point features
+func NewFeatureCollection(records []VehicleRecord) FeatureCollection {
+	fc := FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]Feature, 0, len(records)),
+	}
+
+	for _, r := range records {
+		fc.Features = append(fc.Features, Feature{
+			Type: "Feature",
+			ID:   r.ID,
+			Geometry: model.Geometry{
+				Type:        "Point",
+				Coordinates: []float64{r.Longitude, r.Latitude},
+			},
+			Properties: model.FeatureProperties{
+				Label:           r.Label,
+				Speed:           r.Speed,
+				Bearing:         r.Bearing,
+				DirectionID:     r.DirectionID,
+				CurrentStatus:   r.CurrentStatus,
+				OccupancyStatus: r.OccupancyStatus,
+				RouteID:         r.RouteID,
+				TripID:          r.TripID,
+				StopID:          r.StopID,
+				UpdatedAt:       r.UpdatedAt,
+			},
+		})
+	}
+
+	return fc
+}
+
+// GetGeoJSON returns current vehicle positions matching f as a FeatureCollection
+func (p *ETLPipeline) GetGeoJSON(f VehicleFilter) (*FeatureCollection, error) {
+	return p.GetGeoJSONContext(context.Background(), f)
+}
+
+// GetGeoJSONContext is GetGeoJSON with a context
+func (p *ETLPipeline) GetGeoJSONContext(ctx context.Context, f VehicleFilter) (*FeatureCollection, error) {
+	records, err := p.FilterVehiclesContext(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := NewFeatureCollection(records)
+	return &fc, nil
+}
@@ -0,0 +1,198 @@
+package pipeline
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// gtfsFile describes how one file of a static GTFS feed maps to its table
+type gtfsFile struct {
+	name     string
+	table    string
+	required bool
+	// columns are copied by header name; the first keyColumns must be present
+	columns    []string
+	keyColumns int
+}
+
+// gtfsFiles are imported in this order. A feed needs calendar.txt,
+// calendar_dates.txt or both; either may be missing on its own.
+var gtfsFiles = []gtfsFile{
+	{
+		name: "routes.txt", table: "gtfs_routes", required: true, keyColumns: 1,
+		columns: []string{"route_id", "agency_id", "route_short_name", "route_long_name", "route_desc", "route_type", "route_color", "route_text_color"},
+	},
+	{
+		name: "stops.txt", table: "gtfs_stops", required: true, keyColumns: 1,
+		columns: []string{"stop_id", "stop_code", "stop_name", "stop_desc", "stop_lat", "stop_lon", "zone_id", "location_type", "parent_station", "platform_code", "wheelchair_boarding"},
+	},
+	{
+		name: "trips.txt", table: "gtfs_trips", required: true, keyColumns: 3,
+		columns: []string{"trip_id", "route_id", "service_id", "trip_headsign", "trip_short_name", "direction_id", "block_id", "shape_id", "wheelchair_accessible"},
+	},
+	{
+		name: "stop_times.txt", table: "gtfs_stop_times", required: true, keyColumns: 3,
+		columns: []string{"trip_id", "stop_sequence", "stop_id", "arrival_time", "departure_time", "stop_headsign", "pickup_type", "drop_off_type", "timepoint"},
+	},
+	{
+		name: "shapes.txt", table: "gtfs_shapes", keyColumns: 4,
+		columns: []string{"shape_id", "shape_pt_sequence", "shape_pt_lat", "shape_pt_lon", "shape_dist_traveled"},
+	},
+	{
+		name: "calendar.txt", table: "gtfs_calendar", keyColumns: 10,
+		columns: []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"},
+	},
+	{
+		name: "calendar_dates.txt", table: "gtfs_calendar_dates", keyColumns: 3,
+		columns: []string{"service_id", "date", "exception_type"},
+	},
+}
+
+// ImportGTFS loads a static GTFS feed (the zip published as e.g.
+// https://cdn.mbta.com/MBTA_GTFS.zip) into the gtfs_* tables and returns the
+// number of rows imported per table. All tables are replaced in a single
+// transaction, so re-importing is idempotent and a failed import leaves the
+// previous schedule in place.
+func (p *ETLPipeline) ImportGTFS(path string) (map[string]int, error) {
+	return p.ImportGTFSContext(context.Background(), path)
+}
+
+// ImportGTFSContext is ImportGTFS with a context; cancelling it rolls the
+// whole import back
+func (p *ETLPipeline) ImportGTFSContext(ctx context.Context, path string) (map[string]int, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GTFS feed: %w", err)
+	}
+	defer zr.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		// Some feeds nest the files in a single directory
+		name := f.Name[strings.LastIndex(f.Name, "/")+1:]
+		files[name] = f
+	}
+	if files["calendar.txt"] == nil && files["calendar_dates.txt"] == nil {
+		return nil, errors.New("GTFS feed has neither calendar.txt nor calendar_dates.txt")
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	counts := make(map[string]int)
+	for _, spec := range gtfsFiles {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+spec.table); err != nil {
+			return nil, fmt.Errorf("failed to clear %s: %w", spec.table, err)
+		}
+
+		f := files[spec.name]
+		if f == nil {
+			if spec.required {
+				return nil, fmt.Errorf("GTFS feed is missing %s", spec.name)
+			}
+			counts[spec.table] = 0
+			continue
+		}
+
+		n, err := importGTFSFile(ctx, tx, spec, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %s: %w", spec.name, err)
+		}
+		counts[spec.table] = n
+		log.Printf("Imported %d rows from %s", n, spec.name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return counts, nil
+}
+
+// importGTFSFile inserts the rows of one CSV file into its table
+func importGTFSFile(ctx context.Context, tx *sql.Tx, spec gtfsFile, f *zip.File) (int, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	r := csv.NewReader(rc)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	// Position of each table column in the file, -1 if absent
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff") // UTF-8 byte order mark
+		}
+		index[strings.TrimSpace(name)] = i
+	}
+	positions := make([]int, len(spec.columns))
+	for i, column := range spec.columns {
+		pos, ok := index[column]
+		if !ok && i < spec.keyColumns {
+			return 0, fmt.Errorf("missing required column %s", column)
+		}
+		if !ok {
+			pos = -1
+		}
+		positions[i] = pos
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(spec.columns)), ", ")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		spec.table, strings.Join(spec.columns, ", "), placeholders,
+	))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, len(spec.columns))
+	count := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		// Empty and missing optional fields are stored as NULL
+		for i, pos := range positions {
+			args[i] = nil
+			if pos >= 0 && pos < len(record) {
+				if value := strings.TrimSpace(record[pos]); value != "" {
+					args[i] = value
+				}
+			}
+		}
+
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			line, _ := r.FieldPos(0)
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
@@ -1,34 +1,234 @@
 package pipeline
 
-import "fmt"
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+// loadBatchSize is the number of vehicles LoadFrom transforms and loads at once
+const loadBatchSize = 1000
 
 // Load: Store data in SQLite
+//
+// Every observation is appended to vehicle_positions (skipping ones already
+// recorded for the same vehicle and updated_at), and the vehicles table is
+// kept as the latest known position of each vehicle. Loaded vehicles are
+// marked active and seen by their run.
 func (p *ETLPipeline) Load(records []VehicleRecord) error {
-	tx, err := p.db.Begin()
+	return p.LoadContext(context.Background(), records)
+}
+
+// LoadContext is Load with a context; if ctx is cancelled before the commit
+// the whole batch is rolled back
+func (p *ETLPipeline) LoadContext(ctx context.Context, records []VehicleRecord) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		return loadRecords(ctx, tx, records)
+	})
+}
+
+// loadRecords writes records to the vehicle tables in tx
+func loadRecords(ctx context.Context, tx *sql.Tx, records []VehicleRecord) error {
+	historyStmt, err := tx.PrepareContext(ctx, `
+		INSERT OR IGNORE INTO vehicle_positions
+		(vehicle_id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, route_id, trip_id, stop_id, updated_at, ingested_at, run_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	defer tx.Rollback()
+	defer historyStmt.Close()
 
-	stmt, err := tx.Prepare(`
-		INSERT OR REPLACE INTO vehicles 
-		(id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, updated_at, ingested_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	latestStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO vehicles 
+		(id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, route_id, trip_id, stop_id, updated_at, ingested_at, run_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			label = excluded.label,
+			latitude = excluded.latitude,
+			longitude = excluded.longitude,
+			speed = excluded.speed,
+			direction_id = excluded.direction_id,
+			current_status = excluded.current_status,
+			occupancy_status = excluded.occupancy_status,
+			bearing = excluded.bearing,
+			route_id = excluded.route_id,
+			trip_id = excluded.trip_id,
+			stop_id = excluded.stop_id,
+			updated_at = excluded.updated_at,
+			ingested_at = excluded.ingested_at,
+			run_id = excluded.run_id
+		WHERE excluded.updated_at >= vehicles.updated_at
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	defer stmt.Close()
+	defer latestStmt.Close()
+
+	// The upsert skips out-of-order positions, but the vehicle was still seen
+	seenStmt, err := tx.PrepareContext(ctx, `
+		UPDATE vehicles SET stale = 0, last_seen_run = COALESCE(?, last_seen_run) WHERE id = ?
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer seenStmt.Close()
 
 	for _, r := range records {
-		_, err := stmt.Exec(
+		// Store timestamps in UTC so they compare correctly as text
+		args := []interface{}{
 			r.ID, r.Label, r.Latitude, r.Longitude, r.Speed,
 			r.DirectionID, r.CurrentStatus, r.OccupancyStatus,
-			r.Bearing, r.UpdatedAt, r.IngestedAt,
-		)
-		if err != nil {
+			r.Bearing, r.RouteID, r.TripID, r.StopID,
+			r.UpdatedAt.UTC(), r.IngestedAt.UTC(), nullInt(r.RunID),
+		}
+		if _, err := historyStmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("failed to insert position for %s: %w", r.ID, err)
+		}
+		if _, err := latestStmt.ExecContext(ctx, args...); err != nil {
 			return fmt.Errorf("failed to insert record %s: %w", r.ID, err)
 		}
+		if _, err := seenStmt.ExecContext(ctx, nullInt(r.RunID), r.ID); err != nil {
+			return fmt.Errorf("failed to mark %s seen: %w", r.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// runTxKey carries the transaction a Run loads all of its batches in
+type runTxKey struct{}
+
+// querier is what the pipeline needs from both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn returns the transaction of the Run ctx belongs to, or the database
+func (p *ETLPipeline) conn(ctx context.Context) querier {
+	if tx, ok := ctx.Value(runTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return p.db
+}
+
+// inTx calls fn in the transaction of the Run ctx belongs to, or else in a
+// transaction of its own that is committed if fn succeeds
+func (p *ETLPipeline) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	if tx, ok := ctx.Value(runTxKey{}).(*sql.Tx); ok {
+		return fn(tx)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LoadFrom streams a vehicles document (e.g. an archived API response) from r
+// and transforms and loads it in batches, so memory use does not grow with
+// the size of the input. Batches already loaded are kept if a later one fails.
+// The load is recorded as one run in the ingestion_runs ledger, named after r
+// if it has a Name method (as *os.File does).
+func (p *ETLPipeline) LoadFrom(r io.Reader) (RunResult, error) {
+	return p.LoadFromContext(context.Background(), r)
+}
+
+// LoadFromContext is LoadFrom with a context; cancelling it rolls back the
+// batch in progress
+func (p *ETLPipeline) LoadFromContext(ctx context.Context, r io.Reader) (RunResult, error) {
+	source := fmt.Sprintf("%T", r)
+	if named, ok := r.(interface{ Name() string }); ok {
+		source = named.Name()
+	}
+
+	return p.recordRun(ctx, source, func(runID int64) (RunResult, error) {
+		return p.loadEach(ctx, runID, func(fn func(Vehicle) error) error {
+			_, err := DecodeVehicles(r, fn)
+			return err
+		})
+	})
+}
+
+// loadEach transforms and loads the vehicles decode passes to its callback
+// in batches of loadBatchSize, tagging the records with runID
+func (p *ETLPipeline) loadEach(ctx context.Context, runID int64, decode func(fn func(Vehicle) error) error) (RunResult, error) {
+	result := RunResult{RunID: runID}
+	start := p.clock.Now()
+
+	batch := make([]Vehicle, 0, loadBatchSize)
+	flush := func() error {
+		vehicles, rejected, err := p.validate(ctx, runID, batch)
+		if err != nil {
+			return fmt.Errorf("validate failed: %w", err)
+		}
+		result.addRejected(rejected)
+
+		records, err := p.transformer.Transform(ctx, vehicles)
+		if err != nil {
+			return fmt.Errorf("transform failed: %w", err)
+		}
+		for i := range records {
+			records[i].RunID = runID
+		}
+		result.Transformed += len(records)
+		result.Skipped += len(vehicles) - len(records)
+		if err := p.load(ctx, records); err != nil {
+			return fmt.Errorf("load failed: %w", err)
+		}
+		result.Loaded += len(records)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := decode(func(v Vehicle) error {
+		result.Extracted++
+		batch = append(batch, v)
+		if len(batch) == loadBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+
+	result.Duration = p.clock.Now().Sub(start)
+	return result, err
+}
+
+// Remove deletes vehicles from the latest table, keeping their position history
+func (p *ETLPipeline) Remove(ids []string) error {
+	return p.RemoveContext(context.Background(), ids)
+}
+
+// RemoveContext is Remove with a context
+func (p *ETLPipeline) RemoveContext(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM vehicles WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to remove vehicle %s: %w", id, err)
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -0,0 +1,571 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is one versioned schema change. up and down run inside the same
+// transaction that records the change in schema_migrations.
+//
+// Databases created before schema_migrations existed already have some of
+// these tables and columns, so every up step must be safe to run against
+// them: tables use IF NOT EXISTS and columns are added with addColumn.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+	down    func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations in the order they are applied; never edit or reorder one that
+// has shipped, append a new one instead
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create vehicles",
+		up: execSQL(`
+			CREATE TABLE IF NOT EXISTS vehicles (
+				id TEXT PRIMARY KEY,
+				label TEXT NOT NULL,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				speed REAL NOT NULL,
+				direction_id INTEGER NOT NULL,
+				current_status TEXT NOT NULL,
+				occupancy_status TEXT NOT NULL,
+				bearing INTEGER NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				ingested_at TIMESTAMP NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_updated_at ON vehicles(updated_at);
+			CREATE INDEX IF NOT EXISTS idx_label ON vehicles(label);
+		`),
+		down: execSQL(`DROP TABLE vehicles;`),
+	},
+	{
+		version: 2,
+		name:    "add vehicle position history",
+		up: execSQL(`
+			-- Append-only history of every observed position
+			CREATE TABLE IF NOT EXISTS vehicle_positions (
+				vehicle_id TEXT NOT NULL,
+				label TEXT NOT NULL,
+				latitude REAL NOT NULL,
+				longitude REAL NOT NULL,
+				speed REAL NOT NULL,
+				direction_id INTEGER NOT NULL,
+				current_status TEXT NOT NULL,
+				occupancy_status TEXT NOT NULL,
+				bearing INTEGER NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				ingested_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (vehicle_id, updated_at)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_positions_updated_at ON vehicle_positions(updated_at);
+		`),
+		down: execSQL(`DROP TABLE vehicle_positions;`),
+	},
+	{
+		version: 3,
+		name:    "add route, trip and stop ids",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			for _, table := range []string{"vehicles", "vehicle_positions"} {
+				for _, column := range []string{"route_id", "trip_id", "stop_id"} {
+					if err := addColumn(ctx, tx, table, column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+						return err
+					}
+				}
+			}
+			_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_route_id ON vehicles(route_id)`)
+			return err
+		},
+		down: execSQL(`
+			DROP INDEX IF EXISTS idx_route_id;
+			ALTER TABLE vehicles DROP COLUMN route_id;
+			ALTER TABLE vehicles DROP COLUMN trip_id;
+			ALTER TABLE vehicles DROP COLUMN stop_id;
+			ALTER TABLE vehicle_positions DROP COLUMN route_id;
+			ALTER TABLE vehicle_positions DROP COLUMN trip_id;
+			ALTER TABLE vehicle_positions DROP COLUMN stop_id;
+		`),
+	},
+	{
+		version: 4,
+		name:    "add routes",
+		up: execSQL(`
+			-- Route metadata from the MBTA /routes endpoint
+			CREATE TABLE IF NOT EXISTS routes (
+				id TEXT PRIMARY KEY,
+				long_name TEXT NOT NULL,
+				short_name TEXT NOT NULL,
+				type INTEGER NOT NULL,
+				color TEXT NOT NULL,
+				text_color TEXT NOT NULL
+			);
+		`),
+		down: execSQL(`DROP TABLE routes;`),
+	},
+	{
+		version: 5,
+		name:    "add http validators",
+		up: execSQL(`
+			-- Last response validators per endpoint for conditional requests
+			CREATE TABLE IF NOT EXISTS http_validators (
+				url TEXT PRIMARY KEY,
+				etag TEXT NOT NULL DEFAULT '',
+				last_modified TEXT NOT NULL DEFAULT '',
+				updated_at TIMESTAMP NOT NULL
+			);
+		`),
+		down: execSQL(`DROP TABLE http_validators;`),
+	},
+	{
+		version: 6,
+		name:    "add static gtfs tables",
+		up: execSQL(`
+			-- Static GTFS schedule, replaced by each ImportGTFS
+			CREATE TABLE IF NOT EXISTS gtfs_routes (
+				route_id TEXT PRIMARY KEY,
+				agency_id TEXT,
+				route_short_name TEXT,
+				route_long_name TEXT,
+				route_desc TEXT,
+				route_type INTEGER,
+				route_color TEXT,
+				route_text_color TEXT
+			);
+
+			CREATE TABLE IF NOT EXISTS gtfs_stops (
+				stop_id TEXT PRIMARY KEY,
+				stop_code TEXT,
+				stop_name TEXT,
+				stop_desc TEXT,
+				stop_lat REAL,
+				stop_lon REAL,
+				zone_id TEXT,
+				location_type INTEGER,
+				parent_station TEXT,
+				platform_code TEXT,
+				wheelchair_boarding INTEGER
+			);
+
+			CREATE TABLE IF NOT EXISTS gtfs_trips (
+				trip_id TEXT PRIMARY KEY,
+				route_id TEXT NOT NULL,
+				service_id TEXT NOT NULL,
+				trip_headsign TEXT,
+				trip_short_name TEXT,
+				direction_id INTEGER,
+				block_id TEXT,
+				shape_id TEXT,
+				wheelchair_accessible INTEGER
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_gtfs_trips_route_id ON gtfs_trips(route_id);
+
+			CREATE TABLE IF NOT EXISTS gtfs_stop_times (
+				trip_id TEXT NOT NULL,
+				arrival_time TEXT,
+				departure_time TEXT,
+				stop_id TEXT NOT NULL,
+				stop_sequence INTEGER NOT NULL,
+				stop_headsign TEXT,
+				pickup_type INTEGER,
+				drop_off_type INTEGER,
+				timepoint INTEGER,
+				PRIMARY KEY (trip_id, stop_sequence)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_gtfs_stop_times_stop_id ON gtfs_stop_times(stop_id);
+
+			CREATE TABLE IF NOT EXISTS gtfs_shapes (
+				shape_id TEXT NOT NULL,
+				shape_pt_lat REAL NOT NULL,
+				shape_pt_lon REAL NOT NULL,
+				shape_pt_sequence INTEGER NOT NULL,
+				shape_dist_traveled REAL,
+				PRIMARY KEY (shape_id, shape_pt_sequence)
+			);
+
+			CREATE TABLE IF NOT EXISTS gtfs_calendar (
+				service_id TEXT PRIMARY KEY,
+				monday INTEGER NOT NULL,
+				tuesday INTEGER NOT NULL,
+				wednesday INTEGER NOT NULL,
+				thursday INTEGER NOT NULL,
+				friday INTEGER NOT NULL,
+				saturday INTEGER NOT NULL,
+				sunday INTEGER NOT NULL,
+				start_date TEXT NOT NULL,
+				end_date TEXT NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS gtfs_calendar_dates (
+				service_id TEXT NOT NULL,
+				date TEXT NOT NULL,
+				exception_type INTEGER NOT NULL,
+				PRIMARY KEY (service_id, date)
+			);
+		`),
+		down: execSQL(`
+			DROP TABLE gtfs_routes;
+			DROP TABLE gtfs_stops;
+			DROP TABLE gtfs_trips;
+			DROP TABLE gtfs_stop_times;
+			DROP TABLE gtfs_shapes;
+			DROP TABLE gtfs_calendar;
+			DROP TABLE gtfs_calendar_dates;
+		`),
+	},
+	{
+		version: 7,
+		name:    "add ingestion run ledger",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `
+				-- One row per Run or replayed file, for auditing gaps in the data
+				CREATE TABLE IF NOT EXISTS ingestion_runs (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					started_at TIMESTAMP NOT NULL,
+					finished_at TIMESTAMP,
+					source_url TEXT NOT NULL,
+					extracted INTEGER NOT NULL DEFAULT 0,
+					transformed INTEGER NOT NULL DEFAULT 0,
+					skipped INTEGER NOT NULL DEFAULT 0,
+					loaded INTEGER NOT NULL DEFAULT 0,
+					not_modified INTEGER NOT NULL DEFAULT 0,
+					http_status INTEGER NOT NULL DEFAULT 0,
+					duration_ms INTEGER NOT NULL DEFAULT 0,
+					error TEXT NOT NULL DEFAULT ''
+				);
+			`); err != nil {
+				return err
+			}
+			for _, table := range []string{"vehicles", "vehicle_positions"} {
+				if err := addColumn(ctx, tx, table, "run_id", "INTEGER"); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_positions_run_id ON vehicle_positions(run_id)`)
+			return err
+		},
+		down: execSQL(`
+			DROP INDEX IF EXISTS idx_positions_run_id;
+			ALTER TABLE vehicles DROP COLUMN run_id;
+			ALTER TABLE vehicle_positions DROP COLUMN run_id;
+			DROP TABLE ingestion_runs;
+		`),
+	},
+	{
+		version: 8,
+		name:    "add rejected records",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `
+				-- Vehicles quarantined by validation, with the rule they failed
+				CREATE TABLE IF NOT EXISTS rejected_records (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					run_id INTEGER,
+					vehicle_id TEXT NOT NULL,
+					rule TEXT NOT NULL,
+					detail TEXT NOT NULL,
+					raw TEXT NOT NULL,
+					rejected_at TIMESTAMP NOT NULL
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_rejected_run_id ON rejected_records(run_id);
+				CREATE INDEX IF NOT EXISTS idx_rejected_rule ON rejected_records(rule);
+			`); err != nil {
+				return err
+			}
+			return addColumn(ctx, tx, "ingestion_runs", "rejected", "INTEGER NOT NULL DEFAULT 0")
+		},
+		down: execSQL(`
+			ALTER TABLE ingestion_runs DROP COLUMN rejected;
+			DROP TABLE rejected_records;
+		`),
+	},
+	{
+		version: 9,
+		name:    "track stale vehicles",
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := addColumn(ctx, tx, "vehicles", "last_seen_run", "INTEGER"); err != nil {
+				return err
+			}
+			if err := addColumn(ctx, tx, "vehicles", "stale", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			// Vehicles loaded before this are last seen by the run that loaded them
+			_, err := tx.ExecContext(ctx, `
+				UPDATE vehicles SET last_seen_run = run_id WHERE last_seen_run IS NULL;
+				CREATE INDEX IF NOT EXISTS idx_stale ON vehicles(stale);
+			`)
+			return err
+		},
+		down: execSQL(`
+			DROP INDEX IF EXISTS idx_stale;
+			ALTER TABLE vehicles DROP COLUMN last_seen_run;
+			ALTER TABLE vehicles DROP COLUMN stale;
+		`),
+	},
+	{
+		version: 10,
+		name:    "make speed and bearing nullable",
+		// Zeros stored before this cannot be told apart from real readings
+		// and are kept as they are
+		up:   rebuildVehicleTables(true),
+		down: rebuildVehicleTables(false),
+	},
+}
+
+// rebuildVehicleTables recreates vehicles and vehicle_positions with speed
+// and bearing nullable or not, since SQLite cannot alter a column's
+// constraints. Making them NOT NULL again turns missing readings into 0.
+func rebuildVehicleTables(nullable bool) func(context.Context, *sql.Tx) error {
+	constraint, speed, bearing := "", "speed", "bearing"
+	if !nullable {
+		constraint, speed, bearing = " NOT NULL", "COALESCE(speed, 0)", "COALESCE(bearing, 0)"
+	}
+	columns := func(id string) string {
+		return id + `, label, latitude, longitude, %s, direction_id, current_status, occupancy_status, %s,
+			updated_at, ingested_at, route_id, trip_id, stop_id, run_id`
+	}
+
+	return execSQL(`
+		CREATE TABLE vehicles_new (
+			id TEXT PRIMARY KEY,
+			label TEXT NOT NULL,
+			latitude REAL NOT NULL,
+			longitude REAL NOT NULL,
+			speed REAL` + constraint + `,
+			direction_id INTEGER NOT NULL,
+			current_status TEXT NOT NULL,
+			occupancy_status TEXT NOT NULL,
+			bearing INTEGER` + constraint + `,
+			updated_at TIMESTAMP NOT NULL,
+			ingested_at TIMESTAMP NOT NULL,
+			route_id TEXT NOT NULL DEFAULT '',
+			trip_id TEXT NOT NULL DEFAULT '',
+			stop_id TEXT NOT NULL DEFAULT '',
+			run_id INTEGER,
+			last_seen_run INTEGER,
+			stale INTEGER NOT NULL DEFAULT 0
+		);
+		INSERT INTO vehicles_new SELECT ` + fmt.Sprintf(columns("id"), speed, bearing) + `, last_seen_run, stale FROM vehicles;
+		DROP TABLE vehicles;
+		ALTER TABLE vehicles_new RENAME TO vehicles;
+
+		CREATE INDEX idx_updated_at ON vehicles(updated_at);
+		CREATE INDEX idx_label ON vehicles(label);
+		CREATE INDEX idx_route_id ON vehicles(route_id);
+		CREATE INDEX idx_stale ON vehicles(stale);
+
+		CREATE TABLE vehicle_positions_new (
+			vehicle_id TEXT NOT NULL,
+			label TEXT NOT NULL,
+			latitude REAL NOT NULL,
+			longitude REAL NOT NULL,
+			speed REAL` + constraint + `,
+			direction_id INTEGER NOT NULL,
+			current_status TEXT NOT NULL,
+			occupancy_status TEXT NOT NULL,
+			bearing INTEGER` + constraint + `,
+			updated_at TIMESTAMP NOT NULL,
+			ingested_at TIMESTAMP NOT NULL,
+			route_id TEXT NOT NULL DEFAULT '',
+			trip_id TEXT NOT NULL DEFAULT '',
+			stop_id TEXT NOT NULL DEFAULT '',
+			run_id INTEGER,
+			PRIMARY KEY (vehicle_id, updated_at)
+		);
+		INSERT INTO vehicle_positions_new SELECT ` + fmt.Sprintf(columns("vehicle_id"), speed, bearing) + ` FROM vehicle_positions;
+		DROP TABLE vehicle_positions;
+		ALTER TABLE vehicle_positions_new RENAME TO vehicle_positions;
+
+		CREATE INDEX idx_positions_updated_at ON vehicle_positions(updated_at);
+		CREATE INDEX idx_positions_run_id ON vehicle_positions(run_id);
+	`)
+}
+
+// WithAutoMigrate controls whether NewETLPipeline applies pending migrations
+// (the default). Turn it off to inspect or roll back a database with the
+// Migrate methods without changing it first.
+func WithAutoMigrate(enabled bool) Option {
+	return func(p *ETLPipeline) {
+		p.autoMigrate = enabled
+	}
+}
+
+// Migrations lists every migration this build knows about and whether it has
+// been applied to the database
+func (p *ETLPipeline) Migrations() ([]MigrationStatus, error) {
+	return p.MigrationsContext(context.Background())
+}
+
+// MigrationsContext is Migrations with a context
+func (p *ETLPipeline) MigrationsContext(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := p.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if at, ok := applied[m.version]; ok {
+			at := at.UTC()
+			status.Applied = true
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// MigrateUp applies every pending migration in order, each in its own
+// transaction, and returns how many were applied
+func (p *ETLPipeline) MigrateUp() (int, error) {
+	return p.MigrateUpContext(context.Background())
+}
+
+// MigrateUpContext is MigrateUp with a context; a cancelled context rolls back
+// the migration in progress and keeps the ones already applied
+func (p *ETLPipeline) MigrateUpContext(ctx context.Context) (int, error) {
+	applied, err := p.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	latest := migrations[len(migrations)-1].version
+	for version := range applied {
+		if version > latest {
+			return 0, fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, latest)
+		}
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if err := p.applyMigration(ctx, m, m.up, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				m.version, m.name, p.clock.Now().UTC())
+			return err
+		}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// MigrateDown reverts the most recently applied migration and returns its
+// version, or 0 if none are applied. Reverting drops the tables and columns
+// the migration added, along with their data.
+func (p *ETLPipeline) MigrateDown() (int, error) {
+	return p.MigrateDownContext(context.Background())
+}
+
+// MigrateDownContext is MigrateDown with a context
+func (p *ETLPipeline) MigrateDownContext(ctx context.Context) (int, error) {
+	applied, err := p.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := p.applyMigration(ctx, m, m.down, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.version)
+			return err
+		}); err != nil {
+			return 0, err
+		}
+		return m.version, nil
+	}
+	return 0, nil
+}
+
+// applyMigration runs step and record in one transaction
+func (p *ETLPipeline) applyMigration(ctx context.Context, m migration, step func(context.Context, *sql.Tx) error, record func(*sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := step(ctx, tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+	}
+	if err := record(tx); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", m.version, err)
+	}
+	return nil
+}
+
+// appliedMigrations returns when each applied version was applied, creating
+// schema_migrations if this is the first time the database is migrated
+func (p *ETLPipeline) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	if _, err := p.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	rows, err := p.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// execSQL is a migration step that runs a fixed script
+func execSQL(script string) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, script)
+		return err
+	}
+}
+
+// addColumn adds column to table unless a database from before
+// schema_migrations already has it
+func addColumn(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	var count int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column,
+	).Scan(&count); err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
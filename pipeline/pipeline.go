@@ -1,9 +1,14 @@
 package pipeline
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/notLeoHirano/mbta-etl/model"
 )
@@ -11,82 +16,293 @@ import (
 // Easily readable types
 type Vehicle = model.Vehicle
 type Attributes = model.Attributes
+type Relationships = model.Relationships
+type Relationship = model.Relationship
+type ResourceIdentifier = model.ResourceIdentifier
 type VehicleResponse = model.VehicleResponse
+type Links = model.Links
 type VehicleRecord = model.VehicleRecord
+type Route = model.Route
+type RouteAttributes = model.RouteAttributes
+type RouteResponse = model.RouteResponse
+type RouteStats = model.RouteStats
+type RouteTypeStats = model.RouteTypeStats
+type SummaryStats = model.SummaryStats
+type BearingBucket = model.BearingBucket
+type FeatureCollection = model.FeatureCollection
+type Feature = model.Feature
+type IngestionRun = model.IngestionRun
+type MigrationStatus = model.MigrationStatus
 
+// DefaultRoutesURL is the MBTA endpoint used to sync route metadata
+const DefaultRoutesURL = "https://api-v3.mbta.com/routes"
 
 // ETL Pipeline components
 type ETLPipeline struct {
-	apiURL string
-	db     *sql.DB
+	apiURL      string
+	routesURL   string
+	extractOpts ExtractOptions
+	retry       RetryPolicy
+	client      *http.Client
+	timeout     time.Duration
+	apiKey      string
+	userAgent   string
+	archiveDir  string
+	source      Source
+	extractor   Extractor
+	transformer Transformer
+	loaders     []Loader
+	validation  *ValidationRules
+	stalePolicy StalePolicy
+	showStale   bool
+	db          *sql.DB
+	clock       Clock
+	autoMigrate bool
+
+	mu                sync.Mutex
+	throttledUntil    time.Time
+	pendingValidators map[string]validator
+	archiveSeq        int
+}
+
+// Option configures optional pipeline behaviour
+type Option func(*ETLPipeline)
+
+// WithClock replaces the wall clock, mainly so tests can control time
+func WithClock(c Clock) Option {
+	return func(p *ETLPipeline) {
+		p.clock = c
+	}
+}
+
+// WithRoutesURL overrides the endpoint used by SyncRoutes
+func WithRoutesURL(url string) Option {
+	return func(p *ETLPipeline) {
+		p.routesURL = url
+	}
 }
 
-func NewETLPipeline(apiURL string, dbPath string) (*ETLPipeline, error) {
+// RunResult summarizes a single pipeline run
+type RunResult struct {
+	RunID       int64 // ingestion_runs id
+	Extracted   int
+	Transformed int
+	Skipped     int // extracted vehicles dropped by Transform
+	Rejected    int // extracted vehicles that failed validation
+	Loaded      int
+	Retired     int // vehicles marked stale or deleted by the stale policy
+	Duration    time.Duration
+
+	// RejectedByRule breaks Rejected down by validation rule
+	RejectedByRule map[string]int
+
+	// NotModified is set when the API reported no change and nothing was loaded
+	NotModified bool
+}
+
+func NewETLPipeline(apiURL string, dbPath string, opts ...Option) (*ETLPipeline, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	if err := initDatabase(db); err != nil {
-		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	// Every connection to ":memory:" is a separate database, so share one
+	if dbPath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
+	p := &ETLPipeline{
+		apiURL:    apiURL,
+		routesURL: DefaultRoutesURL,
+		source:    SourceJSONAPI,
+		retry:     DefaultRetryPolicy,
+		userAgent: DefaultUserAgent,
+		db:        db,
+		clock:     realClock{},
+
+		stalePolicy: DefaultStalePolicy,
+		autoMigrate: true,
+	}
+	p.extractor = apiExtractor{p}
+	p.transformer = defaultTransformer{p}
+	p.loaders = []Loader{sqliteLoader{p}}
+	for _, opt := range opts {
+		opt(p)
 	}
+	p.configureClient()
 
-	return &ETLPipeline{
-		apiURL: apiURL,
-		db:     db,
-	}, nil
+	if p.autoMigrate {
+		if _, err := p.MigrateUp(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+
+	return p, nil
 }
 
-func initDatabase(db *sql.DB) error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS vehicles (
-		id TEXT PRIMARY KEY,
-		label TEXT NOT NULL,
-		latitude REAL NOT NULL,
-		longitude REAL NOT NULL,
-		speed REAL NOT NULL,
-		direction_id INTEGER NOT NULL,
-		current_status TEXT NOT NULL,
-		occupancy_status TEXT NOT NULL,
-		bearing INTEGER NOT NULL,
-		updated_at TIMESTAMP NOT NULL,
-		ingested_at TIMESTAMP NOT NULL
-	);
-	
-	CREATE INDEX IF NOT EXISTS idx_updated_at ON vehicles(updated_at);
-	CREATE INDEX IF NOT EXISTS idx_label ON vehicles(label);
-	`
-
-	_, err := db.Exec(schema)
+// Run full pipeline
+func (p *ETLPipeline) Run() error {
+	_, err := p.RunContext(context.Background())
 	return err
 }
 
+// RunContext is Run with a context passed to every stage, returning a summary
+// of the run. Cancelling ctx aborts in-flight requests and rolls back an
+// uncommitted load.
+//
+// The MBTA API is streamed page by page through validation, Transform and
+// Load in batches of loadBatchSize; a custom Extractor's response is loaded
+// as one batch.
+//
+// Every run, including failed and not-modified ones, is recorded in the
+// ingestion_runs ledger and its id is stored on the rows it loads.
+func (p *ETLPipeline) RunContext(ctx context.Context) (RunResult, error) {
+	start := p.clock.Now()
+	var result RunResult
+
+	runID, err := p.startRun(ctx, p.sourceName(), start)
+	if err != nil {
+		return result, err
+	}
+	result.RunID = runID
+
+	var status int
+	err = p.run(context.WithValue(ctx, statusKey{}, &status), &result)
+	result.Duration = p.clock.Now().Sub(start)
+
+	if ledgerErr := p.finishRun(ctx, result, runStatus(status, err), err); ledgerErr != nil {
+		err = errors.Join(err, ledgerErr)
+	}
+	return result, err
+}
+
+// run extracts, transforms and loads once, filling in result as it goes.
+// Every batch is loaded in one transaction, committed once the whole run has
+// succeeded, so a failed or cancelled run leaves the database as it was.
+func (p *ETLPipeline) run(ctx context.Context, result *RunResult) error {
+	// Cancellation is handled by the statements and the rollback below;
+	// tying the transaction to ctx would abort a Watch cycle's commit
+	tx, err := p.db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	ctx = context.WithValue(ctx, runTxKey{}, tx)
 
-// Run full pipeline
-func (p *ETLPipeline) Run() error {
-	// Extract
 	log.Println("Extracting data from MBTA API...")
-	vehicleResp, err := p.Extract()
+	if _, ok := p.extractor.(apiExtractor); ok {
+		err = p.runEach(ctx, result)
+	} else {
+		err = p.runBatch(ctx, result)
+	}
+	if errors.Is(err, ErrNotModified) {
+		log.Println("No change since last run, skipping transform and load")
+		result.NotModified = true
+		// Nothing new was seen, but vehicles can still age out
+		if result.Retired, err = p.retireVehicles(writeContext(ctx), result.RunID, false); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Once its data is stored a Watch cycle finishes even if ctx is cancelled
+	ctx = writeContext(ctx)
+	result.Retired, err = p.retireVehicles(ctx, result.RunID, true)
+	if err != nil {
+		return err
+	}
+	if result.Retired > 0 {
+		log.Printf("Retired %d vehicles no longer in service", result.Retired)
+	}
+
+	// Only remember the response validators once their data is stored
+	if err := p.commitValidators(ctx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// runEach streams the API's pages through loadEach, so memory use stays at
+// one batch of loadBatchSize vehicles however large the fleet is. The batches
+// share the run's transaction, so a later page failing rolls them all back.
+func (p *ETLPipeline) runEach(ctx context.Context, result *RunResult) error {
+	var stageErr error
+	batches, err := p.loadEach(ctx, result.RunID, func(fn func(Vehicle) error) error {
+		err := p.ExtractEachContext(ctx, func(v Vehicle) error {
+			stageErr = fn(v)
+			return stageErr
+		})
+		if err != nil && stageErr == nil {
+			return fmt.Errorf("extract failed: %w", err)
+		}
+		return err
+	})
+
+	result.Extracted = batches.Extracted
+	result.Transformed = batches.Transformed
+	result.Skipped = batches.Skipped
+	result.Loaded = batches.Loaded
+	result.addRejected(batches.RejectedByRule)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Extracted %d vehicles", result.Extracted)
+	if result.Rejected > 0 {
+		log.Printf("Rejected %d vehicles failing validation (%s)", result.Rejected, formatCounts(result.RejectedByRule))
+	}
+	log.Printf("Transformed %d records (%d skipped)", result.Transformed, result.Skipped)
+	log.Printf("Successfully loaded %d records", result.Loaded)
+	return nil
+}
+
+// runBatch loads everything a custom Extractor returns in one batch
+func (p *ETLPipeline) runBatch(ctx context.Context, result *RunResult) error {
+	// Extract
+	vehicleResp, err := p.extractor.Extract(ctx)
 	if err != nil {
 		return fmt.Errorf("extract failed: %w", err)
 	}
-	log.Printf("Extracted %d vehicles", len(vehicleResp.Data))
+	result.Extracted = len(vehicleResp.Data)
+	log.Printf("Extracted %d vehicles", result.Extracted)
+
+	// Validate
+	vehicles, rejected, err := p.validate(ctx, result.RunID, vehicleResp.Data)
+	if err != nil {
+		return fmt.Errorf("validate failed: %w", err)
+	}
+	result.addRejected(rejected)
+	if result.Rejected > 0 {
+		log.Printf("Rejected %d vehicles failing validation (%s)", result.Rejected, formatCounts(rejected))
+	}
 
 	// Transform
 	log.Println("Transforming data...")
-	records, err := p.Transform(vehicleResp.Data)
+	records, err := p.transformer.Transform(ctx, vehicles)
 	if err != nil {
 		return fmt.Errorf("transform failed: %w", err)
 	}
-	log.Printf("Transformed %d records", len(records))
+	for i := range records {
+		records[i].RunID = result.RunID
+	}
+	result.Transformed = len(records)
+	result.Skipped = len(vehicles) - result.Transformed
+	log.Printf("Transformed %d records (%d skipped)", result.Transformed, result.Skipped)
 
 	// Load
 	log.Println("Loading data to database...")
-	if err := p.Load(records); err != nil {
+	if err := p.load(writeContext(ctx), records); err != nil {
 		return fmt.Errorf("load failed: %w", err)
 	}
-	log.Printf("Successfully loaded %d records", len(records))
-
+	result.Loaded = len(records)
+	log.Printf("Successfully loaded %d records", result.Loaded)
 	return nil
 }
 
@@ -1,168 +1,303 @@
 package pipeline
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/notLeoHirano/mbta-etl/model"
 )
 
 // A collection of possible queries to explore the MBTA API
 
+// vehicleColumns lists the vehicles columns in the order scanVehicle expects
+const vehicleColumns = `id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, route_id, trip_id, stop_id, updated_at, ingested_at, run_id, stale`
+
 // Top 10 fastest vehicles currently
 func (p *ETLPipeline) GetTop10FastestVehicles() ([]VehicleRecord, error) {
+	return p.GetTop10FastestVehiclesContext(context.Background())
+}
+
+// GetTop10FastestVehiclesContext is GetTop10FastestVehicles with a context
+func (p *ETLPipeline) GetTop10FastestVehiclesContext(ctx context.Context) ([]VehicleRecord, error) {
 	query := `
-		SELECT id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, updated_at, ingested_at
-		FROM vehicles
+		SELECT ` + vehicleColumns + `
+		FROM ` + p.vehiclesTable() + `
+		WHERE speed IS NOT NULL
 		ORDER BY speed DESC
 		LIMIT 10
 	`
-	return p.queryVehicles(query)
+	return p.queryVehicles(ctx, query)
+}
+
+// All latest vehicle positions, ordered by id
+func (p *ETLPipeline) GetVehicles() ([]VehicleRecord, error) {
+	return p.GetVehiclesContext(context.Background())
+}
+
+// GetVehiclesContext is GetVehicles with a context
+func (p *ETLPipeline) GetVehiclesContext(ctx context.Context) ([]VehicleRecord, error) {
+	return p.FilterVehiclesContext(ctx, VehicleFilter{})
+}
+
+// VehicleFilter narrows FilterVehicles; zero fields match everything
+type VehicleFilter struct {
+	RouteID string
+	Status  string
+	BBox    *BoundingBox
+}
+
+// BoundingBox is a longitude/latitude rectangle
+type BoundingBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// ParseBoundingBox parses "minLon,minLat,maxLon,maxLat"
+func ParseBoundingBox(s string) (*BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bounding box needs 4 comma-separated values, got %q", s)
+	}
+
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bounding box value %q: %w", part, err)
+		}
+		v[i] = f
+	}
+
+	bbox := &BoundingBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if bbox.MinLon > bbox.MaxLon || bbox.MinLat > bbox.MaxLat {
+		return nil, fmt.Errorf("bounding box minimums exceed maximums: %q", s)
+	}
+	return bbox, nil
+}
+
+// FilterVehicles returns latest vehicle positions matching f, ordered by id
+func (p *ETLPipeline) FilterVehicles(f VehicleFilter) ([]VehicleRecord, error) {
+	return p.FilterVehiclesContext(context.Background(), f)
+}
+
+// FilterVehiclesContext is FilterVehicles with a context
+func (p *ETLPipeline) FilterVehiclesContext(ctx context.Context, f VehicleFilter) ([]VehicleRecord, error) {
+	var where []string
+	var args []interface{}
+
+	if f.RouteID != "" {
+		where = append(where, "route_id = ?")
+		args = append(args, f.RouteID)
+	}
+	if f.Status != "" {
+		where = append(where, "current_status = ?")
+		args = append(args, f.Status)
+	}
+	if f.BBox != nil {
+		where = append(where, "longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?")
+		args = append(args, f.BBox.MinLon, f.BBox.MaxLon, f.BBox.MinLat, f.BBox.MaxLat)
+	}
+
+	query := `SELECT ` + vehicleColumns + ` FROM ` + p.vehiclesTable()
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id"
+
+	return p.queryVehicles(ctx, query, args...)
+}
+
+// GetVehicle returns the latest position of a single vehicle, or sql.ErrNoRows
+func (p *ETLPipeline) GetVehicle(id string) (*VehicleRecord, error) {
+	return p.GetVehicleContext(context.Background(), id)
+}
+
+// GetVehicleContext is GetVehicle with a context
+func (p *ETLPipeline) GetVehicleContext(ctx context.Context, id string) (*VehicleRecord, error) {
+	query := `
+		SELECT ` + vehicleColumns + `
+		FROM ` + p.vehiclesTable() + `
+		WHERE id = ?
+	`
+	records, err := p.queryVehicles(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &records[0], nil
 }
 
+// Breakdown by mbta route, joined to the route metadata from SyncRoutes
+func (p *ETLPipeline) GetRouteBreakdown() ([]RouteStats, error) {
+	return p.GetRouteBreakdownContext(context.Background())
+}
 
-// Breakdown by mbta route
-func (p *ETLPipeline) GetRouteBreakdown() ([]map[string]interface{}, error) {
-	// Extract route prefix from vehicle ID (e.g., "R-" for Red, "G-" for Green, "O-" for Orange)
+// GetRouteBreakdownContext is GetRouteBreakdown with a context
+func (p *ETLPipeline) GetRouteBreakdownContext(ctx context.Context) ([]RouteStats, error) {
 	query := `
-		SELECT 
-			CASE 
-				WHEN id LIKE 'R-%' THEN 'Red Line'
-				WHEN id LIKE 'O-%' THEN 'Orange Line'
-				WHEN id LIKE 'G-%' THEN 'Green Line'
-				WHEN id LIKE 'B-%' THEN 'Blue Line'
-				WHEN id LIKE 'y%' THEN 'Bus'
-				WHEN id LIKE 'ynk%' THEN 'Commuter Rail'
-				ELSE 'Other'
-			END as route_type,
+		SELECT
+			v.route_id,
+			COALESCE(r.long_name, ''),
+			COALESCE(r.type, ?),
+			COALESCE(r.color, ''),
 			COUNT(*) as count,
-			AVG(speed) as avg_speed,
-			MAX(speed) as max_speed
-		FROM vehicles
-		GROUP BY route_type
-		ORDER BY count DESC
+			COALESCE(AVG(v.speed), 0) as avg_speed,
+			COALESCE(MAX(v.speed), 0) as max_speed
+		FROM ` + p.vehiclesTable() + ` v
+		LEFT JOIN routes r ON r.id = v.route_id
+		GROUP BY v.route_id
+		ORDER BY count DESC, v.route_id
 	`
-	
-	rows, err := p.db.Query(query)
+
+	rows, err := p.db.QueryContext(ctx, query, model.RouteTypeUnknown)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to query route breakdown: %w", err)
 	}
 	defer rows.Close()
 
-	var results []map[string]interface{}
+	var results []RouteStats
 	for rows.Next() {
-		var routeType string
-		var count int
-		var avgSpeed, maxSpeed float64
-		
-		err := rows.Scan(&routeType, &count, &avgSpeed, &maxSpeed)
+		var r RouteStats
+		err := rows.Scan(&r.RouteID, &r.LongName, &r.RouteType, &r.Color, &r.Count, &r.AvgSpeed, &r.MaxSpeed)
 		if err != nil {
 			return nil, err
 		}
-		
-		results = append(results, map[string]interface{}{
-			"route_type": routeType,
-			"count":      count,
-			"avg_speed":  fmt.Sprintf("%.2f", avgSpeed),
-			"max_speed":  fmt.Sprintf("%.2f", maxSpeed),
-		})
+		r.RouteTypeName = model.RouteTypeName(r.RouteType)
+		results = append(results, r)
 	}
-	
+
 	return results, rows.Err()
 }
 
+// Breakdown by route type (subway, light rail, bus, commuter rail, ferry)
+func (p *ETLPipeline) GetRouteTypeBreakdown() ([]RouteTypeStats, error) {
+	return p.GetRouteTypeBreakdownContext(context.Background())
+}
+
+// GetRouteTypeBreakdownContext is GetRouteTypeBreakdown with a context
+func (p *ETLPipeline) GetRouteTypeBreakdownContext(ctx context.Context) ([]RouteTypeStats, error) {
+	query := `
+		SELECT
+			COALESCE(r.type, ?) as route_type,
+			COUNT(*) as count,
+			COALESCE(AVG(v.speed), 0) as avg_speed,
+			COALESCE(MAX(v.speed), 0) as max_speed
+		FROM ` + p.vehiclesTable() + ` v
+		LEFT JOIN routes r ON r.id = v.route_id
+		GROUP BY route_type
+		ORDER BY count DESC, route_type
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, model.RouteTypeUnknown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query route type breakdown: %w", err)
+	}
+	defer rows.Close()
+
+	var results []RouteTypeStats
+	for rows.Next() {
+		var r RouteTypeStats
+		if err := rows.Scan(&r.RouteType, &r.Count, &r.AvgSpeed, &r.MaxSpeed); err != nil {
+			return nil, err
+		}
+		r.Name = model.RouteTypeName(r.RouteType)
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
 
 // overall summary
-func (p *ETLPipeline) GetSummaryStats() (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+func (p *ETLPipeline) GetSummaryStats() (*SummaryStats, error) {
+	return p.GetSummaryStatsContext(context.Background())
+}
+
+// GetSummaryStatsContext is GetSummaryStats with a context
+func (p *ETLPipeline) GetSummaryStatsContext(ctx context.Context) (*SummaryStats, error) {
+	var stats SummaryStats
 
 	// Basic stats
-	var totalVehicles int
-	var avgSpeed, maxSpeed, minSpeed float64
-	err := p.db.QueryRow(`
-		SELECT COUNT(*), AVG(speed), MAX(speed), MIN(speed)
-		FROM vehicles
-	`).Scan(&totalVehicles, &avgSpeed, &maxSpeed, &minSpeed)
-	
+	err := p.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(AVG(speed), 0), COALESCE(MAX(speed), 0), COALESCE(MIN(speed), 0)
+		FROM `+p.vehiclesTable()+`
+	`).Scan(&stats.TotalVehicles, &stats.AverageSpeed, &stats.MaxSpeed, &stats.MinSpeed)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to query speed stats: %w", err)
 	}
 
-	stats["total_vehicles"] = totalVehicles
-	stats["average_speed"] = fmt.Sprintf("%.2f mph", avgSpeed)
-	stats["max_speed"] = fmt.Sprintf("%.2f mph", maxSpeed)
-	stats["min_speed"] = fmt.Sprintf("%.2f mph", minSpeed)
-
-	// Vehicles by status
-	var inTransit, stopped, incoming int
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE current_status = 'IN_TRANSIT_TO'`).Scan(&inTransit)
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE current_status = 'STOPPED_AT'`).Scan(&stopped)
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE current_status = 'INCOMING_AT'`).Scan(&incoming)
-	
-	stats["in_transit"] = inTransit
-	stats["stopped"] = stopped
-	stats["incoming"] = incoming
+	// Vehicles by status, direction and movement; a NULL speed is neither
+	// moving nor stationary
+	err = p.db.QueryRowContext(ctx, `
+		SELECT
+			COALESCE(SUM(CASE WHEN current_status = 'IN_TRANSIT_TO' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN current_status = 'STOPPED_AT' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN current_status = 'INCOMING_AT' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN direction_id = 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN direction_id = 1 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN speed > 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN speed = 0 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN speed IS NULL THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN bearing IS NULL THEN 1 ELSE 0 END), 0)
+		FROM `+p.vehiclesTable()+`
+	`).Scan(
+		&stats.InTransit, &stats.Stopped, &stats.Incoming,
+		&stats.OutboundVehicles, &stats.InboundVehicles,
+		&stats.MovingVehicles, &stats.StationaryVehicles,
+		&stats.MissingSpeed, &stats.MissingBearing,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query vehicle counts: %w", err)
+	}
 
 	// Occupancy distribution
-	var manySeatsPct, fewSeatsPct, unknownPct float64
-	p.db.QueryRow(`
+	err = p.db.QueryRowContext(ctx, `
 		SELECT 
-			CAST(SUM(CASE WHEN occupancy_status = 'MANY_SEATS_AVAILABLE' THEN 1 ELSE 0 END) AS FLOAT) * 100.0 / COUNT(*),
-			CAST(SUM(CASE WHEN occupancy_status = 'FEW_SEATS_AVAILABLE' THEN 1 ELSE 0 END) AS FLOAT) * 100.0 / COUNT(*),
-			CAST(SUM(CASE WHEN occupancy_status = 'UNKNOWN' THEN 1 ELSE 0 END) AS FLOAT) * 100.0 / COUNT(*)
-		FROM vehicles
-	`).Scan(&manySeatsPct, &fewSeatsPct, &unknownPct)
-	
-	stats["occupancy_many_seats"] = fmt.Sprintf("%.1f%%", manySeatsPct)
-	stats["occupancy_few_seats"] = fmt.Sprintf("%.1f%%", fewSeatsPct)
-	stats["occupancy_unknown"] = fmt.Sprintf("%.1f%%", unknownPct)
-
-	// Direction distribution
-	var direction0, direction1 int
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE direction_id = 0`).Scan(&direction0)
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE direction_id = 1`).Scan(&direction1)
-	
-	stats["outbound_vehicles"] = direction0
-	stats["inbound_vehicles"] = direction1
-
-	// Active vs stationary vehicles
-	var movingVehicles, stationaryVehicles int
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE speed > 0`).Scan(&movingVehicles)
-	p.db.QueryRow(`SELECT COUNT(*) FROM vehicles WHERE speed = 0`).Scan(&stationaryVehicles)
-	
-	stats["moving_vehicles"] = movingVehicles
-	stats["stationary_vehicles"] = stationaryVehicles
-	
-	if totalVehicles > 0 {
-		stats["percent_moving"] = fmt.Sprintf("%.1f%%", float64(movingVehicles)*100.0/float64(totalVehicles))
+			COALESCE(CAST(SUM(CASE WHEN occupancy_status = 'MANY_SEATS_AVAILABLE' THEN 1 ELSE 0 END) AS FLOAT) * 100.0 / COUNT(*), 0),
+			COALESCE(CAST(SUM(CASE WHEN occupancy_status = 'FEW_SEATS_AVAILABLE' THEN 1 ELSE 0 END) AS FLOAT) * 100.0 / COUNT(*), 0),
+			COALESCE(CAST(SUM(CASE WHEN occupancy_status = 'UNKNOWN' THEN 1 ELSE 0 END) AS FLOAT) * 100.0 / COUNT(*), 0)
+		FROM `+p.vehiclesTable()+`
+	`).Scan(&stats.OccupancyManySeats, &stats.OccupancyFewSeats, &stats.OccupancyUnknown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query occupancy: %w", err)
+	}
+
+	// Only vehicles reporting a speed can be counted as moving or not
+	if withSpeed := stats.TotalVehicles - stats.MissingSpeed; withSpeed > 0 {
+		stats.PercentMoving = float64(stats.MovingVehicles) * 100.0 / float64(withSpeed)
 	}
 
 	// Speed percentiles for moving vehicles
-	var p50, p90, p95 float64
-	p.db.QueryRow(`
-		SELECT speed FROM vehicles WHERE speed > 0 
-		ORDER BY speed LIMIT 1 OFFSET (SELECT COUNT(*) FROM vehicles WHERE speed > 0) / 2
-	`).Scan(&p50)
-	p.db.QueryRow(`
-		SELECT speed FROM vehicles WHERE speed > 0 
-		ORDER BY speed LIMIT 1 OFFSET (SELECT COUNT(*) FROM vehicles WHERE speed > 0) * 9 / 10
-	`).Scan(&p90)
-	p.db.QueryRow(`
-		SELECT speed FROM vehicles WHERE speed > 0 
-		ORDER BY speed LIMIT 1 OFFSET (SELECT COUNT(*) FROM vehicles WHERE speed > 0) * 95 / 100
-	`).Scan(&p95)
-	
-	if movingVehicles > 0 {
-		stats["median_speed"] = fmt.Sprintf("%.2f mph", p50)
-		stats["speed_90th_percentile"] = fmt.Sprintf("%.2f mph", p90)
-		stats["speed_95th_percentile"] = fmt.Sprintf("%.2f mph", p95)
+	if stats.MovingVehicles > 0 {
+		percentiles := []struct {
+			dest     *float64
+			fraction string
+		}{
+			{&stats.MedianSpeed, "/ 2"},
+			{&stats.Speed90thPercentile, "* 9 / 10"},
+			{&stats.Speed95thPercentile, "* 95 / 100"},
+		}
+		for _, pct := range percentiles {
+			err := p.db.QueryRowContext(ctx, `
+				SELECT speed FROM `+p.vehiclesTable()+` WHERE speed > 0 
+				ORDER BY speed LIMIT 1 OFFSET (SELECT COUNT(*) FROM `+p.vehiclesTable()+` WHERE speed > 0) `+pct.fraction,
+			).Scan(pct.dest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query speed percentile: %w", err)
+			}
+		}
 	}
 
-	return stats, nil
+	return &stats, nil
 }
 
-
-
 // gets all vehicles
-func (p *ETLPipeline) queryVehicles(query string) ([]VehicleRecord, error) {
-	rows, err := p.db.Query(query)
+func (p *ETLPipeline) queryVehicles(ctx context.Context, query string, args ...interface{}) ([]VehicleRecord, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -170,12 +305,7 @@ func (p *ETLPipeline) queryVehicles(query string) ([]VehicleRecord, error) {
 
 	var records []VehicleRecord
 	for rows.Next() {
-		var r VehicleRecord
-		err := rows.Scan(
-			&r.ID, &r.Label, &r.Latitude, &r.Longitude, &r.Speed,
-			&r.DirectionID, &r.CurrentStatus, &r.OccupancyStatus,
-			&r.Bearing, &r.UpdatedAt, &r.IngestedAt,
-		)
+		r, err := scanVehicle(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -185,110 +315,145 @@ func (p *ETLPipeline) queryVehicles(query string) ([]VehicleRecord, error) {
 	return records, rows.Err()
 }
 
+// scanVehicle reads a row selected with vehicleColumns
+func scanVehicle(rows *sql.Rows) (VehicleRecord, error) {
+	var r VehicleRecord
+	var runID sql.NullInt64
+	err := rows.Scan(
+		&r.ID, &r.Label, &r.Latitude, &r.Longitude, &r.Speed,
+		&r.DirectionID, &r.CurrentStatus, &r.OccupancyStatus,
+		&r.Bearing, &r.RouteID, &r.TripID, &r.StopID,
+		&r.UpdatedAt, &r.IngestedAt, &runID, &r.Stale,
+	)
+	r.RunID = runID.Int64
+	return r, err
+}
 
-// GetVehiclesByBearing sees which vehicles are pointed within a cone of 2 * delta degrees 
+// GetVehiclesByBearing sees which vehicles are pointed within a cone of 2 * delta degrees,
+// closest heading first. The target wraps around 0/360, so 355 ± 15 also matches 0-10.
 func (p *ETLPipeline) GetVehiclesByBearing(target float64, delta float64) ([]VehicleRecord, error) {
-    minBearing := target - delta
-    maxBearing := target + delta
+	return p.GetVehiclesByBearingContext(context.Background(), target, delta)
+}
+
+// GetVehiclesByBearingContext is GetVehiclesByBearing with a context
+func (p *ETLPipeline) GetVehiclesByBearingContext(ctx context.Context, target float64, delta float64) ([]VehicleRecord, error) {
+	target = NormalizeBearing(target)
+	delta = math.Abs(delta)
 
-    query := `
-        SELECT id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, updated_at, ingested_at
-        FROM vehicles
-        WHERE bearing BETWEEN ? AND ?
+	// Both bearing and target are in [0, 360), so the angular distance is
+	// the smaller of the direct difference and the way around the circle
+	query := `
+        SELECT ` + vehicleColumns + `
+        FROM ` + p.vehiclesTable() + `
+        WHERE MIN(ABS(bearing - ?1), 360 - ABS(bearing - ?1)) <= ?2
+        ORDER BY MIN(ABS(bearing - ?1), 360 - ABS(bearing - ?1)), id
     `
 
-    rows, err := p.db.Query(query, minBearing, maxBearing)
-    if err != nil {
-        return nil, fmt.Errorf("failed to query vehicles by bearing: %w", err)
-    }
-    defer rows.Close()
-
-    var results []VehicleRecord
-    for rows.Next() {
-        var v VehicleRecord
-        if err := rows.Scan(
-            &v.ID, &v.Label, &v.Latitude, &v.Longitude, &v.Speed,
-            &v.DirectionID, &v.CurrentStatus, &v.OccupancyStatus,
-            &v.Bearing, &v.UpdatedAt, &v.IngestedAt,
-        ); err != nil {
-            return nil, err
-        }
-        results = append(results, v)
-    }
-
-    return results, nil
-}
-
-
-// GetBearingSummary returns summary of what direction each vehicle is pointing
-func (p *ETLPipeline) GetBearingSummary() (map[string]int, error) {
-    // Cardinal directions with approximate ranges
-    directions := map[string][2]float64{
-        "North":     {337.5, 22.5},  // Wraps around 0
-        "Northeast": {22.5, 67.5},
-        "East":      {67.5, 112.5},
-        "Southeast": {112.5, 157.5},
-        "South":     {157.5, 202.5},
-        "Southwest": {202.5, 247.5},
-        "West":      {247.5, 292.5},
-        "Northwest": {292.5, 337.5},
-    }
-
-    summary := make(map[string]int)
-
-    // Initialize counts
-    for dir := range directions {
-        summary[dir] = 0
-    }
-
-    rows, err := p.db.Query("SELECT bearing FROM vehicles")
-    if err != nil {
-        return nil, err
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        var bearing int
-        if err := rows.Scan(&bearing); err != nil {
-            return nil, err
-        }
-
-        // Determine which cardinal direction it belongs to
-        found := false
-        for dir, r := range directions {
-            min, max := r[0], r[1]
-            if dir == "North" && (float64(bearing) >= min || float64(bearing) < max) {
-                summary[dir]++
-                found = true
-                break
-            } else if dir != "North" && float64(bearing) >= min && float64(bearing) < max {
-                summary[dir]++
-                found = true
-                break
-            }
-        }
-        if !found {
-            summary["North"]++ // fallback if bearing is exactly 360
-        }
-    }
-
-    return summary, nil
-}
-
-
-
-// CountVehicles returns the total number of records in the vehicles table.
+	results, err := p.queryVehicles(ctx, query, target, delta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query vehicles by bearing: %w", err)
+	}
+
+	return results, nil
+}
+
+// NormalizeBearing maps any angle in degrees into [0, 360)
+func NormalizeBearing(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
+
+// AngularDistance is the smallest angle between two bearings, in [0, 180]
+func AngularDistance(a, b float64) float64 {
+	d := math.Abs(NormalizeBearing(a) - NormalizeBearing(b))
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+// Compass directions in the order GetBearingSummary reports them, each
+// covering 45 degrees centred on its heading
+var compassDirections = []string{
+	"North", "Northeast", "East", "Southeast",
+	"South", "Southwest", "West", "Northwest",
+}
+
+// GetBearingSummary returns how many vehicles point in each compass direction,
+// always in the fixed order North, Northeast, ... Northwest. Vehicles without
+// a bearing are left out; GetSummaryStats counts them as MissingBearing.
+func (p *ETLPipeline) GetBearingSummary() ([]BearingBucket, error) {
+	return p.GetBearingSummaryContext(context.Background())
+}
+
+// GetBearingSummaryContext is GetBearingSummary with a context
+func (p *ETLPipeline) GetBearingSummaryContext(ctx context.Context) ([]BearingBucket, error) {
+	summary := make([]BearingBucket, len(compassDirections))
+	for i, dir := range compassDirections {
+		summary[i].Direction = dir
+	}
+
+	rows, err := p.db.QueryContext(ctx, "SELECT bearing FROM "+p.vehiclesTable()+" WHERE bearing IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bearing int
+		if err := rows.Scan(&bearing); err != nil {
+			return nil, err
+		}
+
+		// Shift by half a sector so North covers 337.5-22.5
+		sector := int(NormalizeBearing(float64(bearing)+22.5) / 45)
+		summary[sector%len(compassDirections)].Count++
+	}
+
+	return summary, rows.Err()
+}
+
+// CountVehicles returns the number of vehicles in the vehicles table,
+// leaving out stale ones unless WithIncludeStale is set.
 func (p *ETLPipeline) CountVehicles() (int, error) {
+	return p.CountVehiclesContext(context.Background())
+}
+
+// CountVehiclesContext is CountVehicles with a context
+func (p *ETLPipeline) CountVehiclesContext(ctx context.Context) (int, error) {
 	var count int
-	err := p.db.QueryRow("SELECT COUNT(*) FROM vehicles").Scan(&count)
+	err := p.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+p.vehiclesTable()).Scan(&count)
 	return count, err
 }
 
+// GetVehicleHistory returns every recorded position of a vehicle, oldest first.
+func (p *ETLPipeline) GetVehicleHistory(id string) ([]VehicleRecord, error) {
+	return p.GetVehicleHistoryContext(context.Background(), id)
+}
 
+// GetVehicleHistoryContext is GetVehicleHistory with a context
+func (p *ETLPipeline) GetVehicleHistoryContext(ctx context.Context, id string) ([]VehicleRecord, error) {
+	query := `
+		SELECT vehicle_id, label, latitude, longitude, speed, direction_id, current_status, occupancy_status, bearing, route_id, trip_id, stop_id, updated_at, ingested_at, run_id, 0
+		FROM vehicle_positions
+		WHERE vehicle_id = ?
+		ORDER BY updated_at
+	`
+	return p.queryVehicles(ctx, query, id)
+}
+
+// GetVehicleSpeed returns the speed of a vehicle by its ID, or nil if it did
+// not report one.
+func (p *ETLPipeline) GetVehicleSpeed(id string) (*float64, error) {
+	return p.GetVehicleSpeedContext(context.Background(), id)
+}
 
-// GetVehicleSpeed returns the speed of a vehicle by its ID.
-func (p *ETLPipeline) GetVehicleSpeed(id string) (float64, error) {
-	var speed float64
-	err := p.db.QueryRow("SELECT speed FROM vehicles WHERE id = ?", id).Scan(&speed)
+// GetVehicleSpeedContext is GetVehicleSpeed with a context
+func (p *ETLPipeline) GetVehicleSpeedContext(ctx context.Context, id string) (*float64, error) {
+	var speed *float64
+	err := p.db.QueryRowContext(ctx, "SELECT speed FROM "+p.vehiclesTable()+" WHERE id = ?", id).Scan(&speed)
 	return speed, err
 }
@@ -0,0 +1,255 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how failed MBTA API calls are retried.
+//
+// Timeouts, refused or dropped connections and 5xx responses are retried
+// with jittered exponential backoff. 429 responses wait until x-ratelimit-reset instead.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// DefaultRetryPolicy is used unless WithRetryPolicy overrides it
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	BaseDelay:  250 * time.Millisecond,
+	MaxDelay:   30 * time.Second,
+}
+
+// maxRateLimitWait bounds how long a bogus reset header can stall us
+const maxRateLimitWait = 5 * time.Minute
+
+// WithRetryPolicy overrides DefaultRetryPolicy; a zero policy disables retries
+func WithRetryPolicy(rp RetryPolicy) Option {
+	return func(p *ETLPipeline) {
+		p.retry = rp
+	}
+}
+
+// FetchError is returned when an API call gives up.
+// Transient failures (timeouts, dropped connections, 5xx, 429) may succeed on
+// a later run; permanent ones (other 4xx, bad URLs, TLS or DNS failures) will
+// not.
+type FetchError struct {
+	URL        string
+	StatusCode int // 0 if no response was received
+	Attempts   int
+	Transient  bool
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	kind := "permanent"
+	if e.Transient {
+		kind = "transient"
+	}
+	return fmt.Sprintf("%s failure after %d attempt(s): %v", kind, e.Attempts, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether err comes from an API call that may succeed if retried later
+func IsTransient(err error) bool {
+	var fetchErr *FetchError
+	return errors.As(err, &fetchErr) && fetchErr.Transient
+}
+
+// get GETs url with the extra headers, retrying according to the pipeline's
+// RetryPolicy. The caller must close the body of the returned 200 or 304
+// response. Cancelling ctx aborts the request and any wait between retries.
+func (p *ETLPipeline) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if err := p.waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
+
+		req, err := p.newRequest(ctx, url)
+		if err != nil {
+			return nil, &FetchError{URL: url, Attempts: attempt, Err: fmt.Errorf("failed to create request: %w", err)}
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		resp, err := p.client.Do(req)
+		if err == nil {
+			recordStatus(ctx, resp.StatusCode)
+		}
+		fetchErr := &FetchError{URL: url, Attempts: attempt}
+		var wait time.Duration
+
+		switch {
+		case err != nil && ctx.Err() != nil:
+			// Cancelled by the caller, not a failure worth retrying
+			fetchErr.Err = fmt.Errorf("failed to fetch data: %w", err)
+			return nil, fetchErr
+		case err != nil:
+			fetchErr.Err = fmt.Errorf("failed to fetch data: %w", err)
+			fetchErr.Transient = isTransientNetError(err)
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified:
+			p.noteRateLimit(resp.Header)
+			return resp, nil
+		default:
+			resp.Body.Close()
+			fetchErr.StatusCode = resp.StatusCode
+			fetchErr.Err = fmt.Errorf("API returned status %d", resp.StatusCode)
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests:
+				fetchErr.Transient = true
+				wait = p.rateLimitWait(resp.Header)
+			case resp.StatusCode >= 500:
+				fetchErr.Transient = true
+			}
+		}
+
+		if !fetchErr.Transient || attempt > p.retry.MaxRetries {
+			return nil, fetchErr
+		}
+
+		if wait == 0 {
+			wait = p.retry.backoff(attempt)
+		}
+		log.Printf("Request to %s failed (%v), retrying in %v (attempt %d of %d)",
+			url, fetchErr.Err, wait, attempt+1, p.retry.MaxRetries+1)
+		if err := p.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for d on the pipeline clock, returning early if ctx is done
+func (p *ETLPipeline) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.clock.After(d):
+		return nil
+	}
+}
+
+// backoff returns the jittered delay before retry number attempt (1-based)
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.BaseDelay
+	for i := 1; i < attempt && d < rp.MaxDelay; i++ {
+		d *= 2
+	}
+	if rp.MaxDelay > 0 && d > rp.MaxDelay {
+		d = rp.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	// Equal jitter: half fixed, half random, so retries from many
+	// workers spread out without collapsing to zero
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// rateLimitWait returns how long until the rate limit window resets
+func (p *ETLPipeline) rateLimitWait(h http.Header) time.Duration {
+	reset, err := strconv.ParseInt(h.Get("x-ratelimit-reset"), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	wait := time.Unix(reset, 0).Sub(p.clock.Now())
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+	return wait
+}
+
+// noteRateLimit remembers when an exhausted rate limit resets so the next
+// request waits instead of being rejected
+func (p *ETLPipeline) noteRateLimit(h http.Header) {
+	if h.Get("x-ratelimit-remaining") != "0" {
+		return
+	}
+	if wait := p.rateLimitWait(h); wait > 0 {
+		p.mu.Lock()
+		p.throttledUntil = p.clock.Now().Add(wait)
+		p.mu.Unlock()
+	}
+}
+
+// waitForRateLimit sleeps until a previously exhausted rate limit resets
+func (p *ETLPipeline) waitForRateLimit(ctx context.Context) error {
+	p.mu.Lock()
+	wait := p.throttledUntil.Sub(p.clock.Now())
+	p.throttledUntil = time.Time{}
+	p.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	log.Printf("Rate limit exhausted, waiting %v for reset", wait)
+	return p.sleep(ctx, wait)
+}
+
+// isTransientNetError reports whether a transport error is worth retrying:
+// timeouts, refused or reset connections and connections closed early. Bad
+// URLs, TLS failures and unknown hosts are permanent.
+func isTransientNetError(err error) bool {
+	// *url.Error is itself a net.Error, so only trust its Timeout
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// decodeBody passes a response body to decode. A failure reading the body,
+// such as a timeout mid-response, is returned as a *FetchError rather than
+// whatever error decode wraps it in. The body is not retried since decode may
+// have consumed part of it.
+func decodeBody(url string, body io.Reader, decode func(io.Reader) error) error {
+	r := &bodyReader{r: body}
+	err := decode(r)
+	if err != nil && r.err != nil {
+		return &FetchError{
+			URL:       url,
+			Attempts:  1,
+			Transient: isTransientNetError(r.err),
+			Err:       fmt.Errorf("failed to read response: %w", r.err),
+		}
+	}
+	return err
+}
+
+// bodyReader remembers the error from reading a response body
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// ExtractRoutes fetches route metadata from the MBTA /routes endpoint
+func (p *ETLPipeline) ExtractRoutes() (*RouteResponse, error) {
+	return p.ExtractRoutesContext(context.Background())
+}
+
+// ExtractRoutesContext is ExtractRoutes with a context
+func (p *ETLPipeline) ExtractRoutesContext(ctx context.Context) (*RouteResponse, error) {
+	var routeResp RouteResponse
+	if err := p.fetchJSON(ctx, p.routesURL, &routeResp); err != nil {
+		return nil, err
+	}
+
+	return &routeResp, nil
+}
+
+// LoadRoutes replaces the routes table with the given routes
+func (p *ETLPipeline) LoadRoutes(routes []Route) error {
+	return p.LoadRoutesContext(context.Background(), routes)
+}
+
+// LoadRoutesContext is LoadRoutes with a context
+func (p *ETLPipeline) LoadRoutesContext(ctx context.Context, routes []Route) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM routes"); err != nil {
+		return fmt.Errorf("failed to clear routes: %w", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO routes (id, long_name, short_name, type, color, text_color)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range routes {
+		if r.ID == "" {
+			continue
+		}
+		_, err := stmt.ExecContext(ctx,
+			r.ID, r.Attributes.LongName, r.Attributes.ShortName,
+			r.Attributes.Type, r.Attributes.Color, r.Attributes.TextColor,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert route %s: %w", r.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// SyncRoutes refreshes the routes table from the MBTA API
+func (p *ETLPipeline) SyncRoutes() (int, error) {
+	return p.SyncRoutesContext(context.Background())
+}
+
+// SyncRoutesContext is SyncRoutes with a context
+func (p *ETLPipeline) SyncRoutesContext(ctx context.Context) (int, error) {
+	log.Println("Fetching routes from MBTA API...")
+	routeResp, err := p.ExtractRoutesContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("extract routes failed: %w", err)
+	}
+
+	if err := p.LoadRoutesContext(ctx, routeResp.Data); err != nil {
+		return 0, fmt.Errorf("load routes failed: %w", err)
+	}
+	log.Printf("Synced %d routes", len(routeResp.Data))
+
+	return len(routeResp.Data), nil
+}
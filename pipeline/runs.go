@@ -0,0 +1,146 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// statusKey carries a *int in a run's context that get fills with the HTTP
+// status of each response, for the run ledger
+type statusKey struct{}
+
+// recordStatus notes an HTTP status on the run in ctx, if any
+func recordStatus(ctx context.Context, status int) {
+	if s, ok := ctx.Value(statusKey{}).(*int); ok {
+		*s = status
+	}
+}
+
+// nullInt stores 0 as NULL
+func nullInt(v int64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// sourceName describes where the configured extractor reads from
+func (p *ETLPipeline) sourceName() string {
+	switch e := p.extractor.(type) {
+	case apiExtractor:
+		if p.source == SourceGTFSRT {
+			return p.apiURL
+		}
+		if u, err := p.requestURL(); err == nil {
+			return u
+		}
+		return p.apiURL
+	case FileExtractor:
+		return e.Path
+	default:
+		return fmt.Sprintf("%T", e)
+	}
+}
+
+// startRun inserts an in-progress row into the ingestion_runs ledger
+func (p *ETLPipeline) startRun(ctx context.Context, source string, start time.Time) (int64, error) {
+	res, err := p.db.ExecContext(ctx,
+		"INSERT INTO ingestion_runs (started_at, source_url) VALUES (?, ?)",
+		start.UTC(), source,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record run: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// recordRun runs load as one ledger run from source, recording its outcome
+func (p *ETLPipeline) recordRun(ctx context.Context, source string, load func(runID int64) (RunResult, error)) (RunResult, error) {
+	start := p.clock.Now()
+	runID, err := p.startRun(ctx, source, start)
+	if err != nil {
+		return RunResult{}, err
+	}
+
+	result, err := load(runID)
+	result.RunID = runID
+	result.Duration = p.clock.Now().Sub(start)
+
+	if ledgerErr := p.finishRun(ctx, result, 0, err); ledgerErr != nil {
+		err = errors.Join(err, ledgerErr)
+	}
+	return result, err
+}
+
+// finishRun records the outcome of a run. It uses a context without ctx's
+// cancellation so a cancelled run is still recorded as failed.
+func (p *ETLPipeline) finishRun(ctx context.Context, result RunResult, httpStatus int, runErr error) error {
+	var errText string
+	if runErr != nil {
+		errText = runErr.Error()
+	}
+
+	_, err := p.db.ExecContext(context.WithoutCancel(ctx), `
+		UPDATE ingestion_runs SET
+			finished_at = ?, extracted = ?, transformed = ?, skipped = ?, rejected = ?, loaded = ?,
+			not_modified = ?, http_status = ?, duration_ms = ?, error = ?
+		WHERE id = ?
+	`, p.clock.Now().UTC(), result.Extracted, result.Transformed, result.Skipped, result.Rejected, result.Loaded,
+		result.NotModified, httpStatus, result.Duration.Milliseconds(), errText, result.RunID)
+	if err != nil {
+		return fmt.Errorf("failed to record run %d: %w", result.RunID, err)
+	}
+	return nil
+}
+
+// runStatus returns the HTTP status a run ended with: that of the last
+// response, or of the error that stopped it
+func runStatus(recorded int, err error) int {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.StatusCode
+	}
+	return recorded
+}
+
+// GetRecentRuns returns up to limit ingestion runs, newest first
+func (p *ETLPipeline) GetRecentRuns(limit int) ([]IngestionRun, error) {
+	return p.GetRecentRunsContext(context.Background(), limit)
+}
+
+// GetRecentRunsContext is GetRecentRuns with a context
+func (p *ETLPipeline) GetRecentRunsContext(ctx context.Context, limit int) ([]IngestionRun, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT id, started_at, finished_at, source_url, extracted, transformed, skipped, rejected, loaded,
+			not_modified, http_status, duration_ms, error
+		FROM ingestion_runs
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []IngestionRun
+	for rows.Next() {
+		var r IngestionRun
+		var finished sql.NullTime
+		err := rows.Scan(
+			&r.ID, &r.StartedAt, &finished, &r.SourceURL, &r.Extracted, &r.Transformed, &r.Skipped, &r.Rejected, &r.Loaded,
+			&r.NotModified, &r.HTTPStatus, &r.DurationMS, &r.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if finished.Valid {
+			r.FinishedAt = &finished.Time
+		}
+		runs = append(runs, r)
+	}
+
+	return runs, rows.Err()
+}
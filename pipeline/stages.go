@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Extractor fetches one batch of raw vehicles per run. Returning
+// ErrNotModified skips the run's transform and load. Each stage should stop
+// and return an error once ctx is done.
+type Extractor interface {
+	Extract(ctx context.Context) (*VehicleResponse, error)
+}
+
+// Transformer cleans and normalizes extracted vehicles into records
+type Transformer interface {
+	Transform(ctx context.Context, vehicles []Vehicle) ([]VehicleRecord, error)
+}
+
+// Loader stores transformed records in a sink
+type Loader interface {
+	Load(ctx context.Context, records []VehicleRecord) error
+}
+
+// WithExtractor replaces the MBTA API extractor used by Run
+func WithExtractor(e Extractor) Option {
+	return func(p *ETLPipeline) {
+		p.extractor = e
+	}
+}
+
+// WithTransformer replaces the default transform used by Run, Stream and
+// LoadFrom
+func WithTransformer(t Transformer) Option {
+	return func(p *ETLPipeline) {
+		p.transformer = t
+	}
+}
+
+// WithLoader adds a sink that receives every batch of records after the
+// SQLite database, which is always loaded first since the queries read it.
+// It may be given more than once. If a loader fails, the run's SQLite
+// transaction is rolled back, but other sinks keep what they were given.
+func WithLoader(l Loader) Option {
+	return func(p *ETLPipeline) {
+		p.loaders = append(p.loaders, l)
+	}
+}
+
+// The built-in stages, backed by the pipeline's own methods
+type (
+	apiExtractor       struct{ p *ETLPipeline }
+	defaultTransformer struct{ p *ETLPipeline }
+	sqliteLoader       struct{ p *ETLPipeline }
+)
+
+func (e apiExtractor) Extract(ctx context.Context) (*VehicleResponse, error) {
+	return e.p.ExtractContext(ctx)
+}
+
+func (t defaultTransformer) Transform(ctx context.Context, vehicles []Vehicle) ([]VehicleRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.p.Transform(vehicles)
+}
+
+func (l sqliteLoader) Load(ctx context.Context, records []VehicleRecord) error {
+	return l.p.LoadContext(ctx, records)
+}
+
+// load passes records to every loader in order. All loaders are tried even
+// if one fails, and their errors are joined.
+func (p *ETLPipeline) load(ctx context.Context, records []VehicleRecord) error {
+	var errs []error
+	for i, l := range p.loaders {
+		if err := l.Load(ctx, records); err != nil {
+			errs = append(errs, fmt.Errorf("loader %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileExtractor is an Extractor that reads a saved vehicles document, such as
+// one written by WithArchiveDir, instead of calling the API. Paths ending in
+// .gz are decompressed.
+type FileExtractor struct {
+	Path string
+}
+
+func (f FileExtractor) Extract(ctx context.Context) (*VehicleResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r, err := openFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var resp VehicleResponse
+	doc, err := DecodeVehicles(r, func(v Vehicle) error {
+		resp.Data = append(resp.Data, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Links = doc.Links
+	resp.Included = doc.Included
+
+	return &resp, nil
+}
@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// StalePolicy decides when a vehicle in the latest table has left service.
+// Run applies it after each successful load, and Stream on each reset and to
+// the vehicles a remove event names; departed vehicles keep their position
+// history either way.
+type StalePolicy struct {
+	// Absent retires vehicles missing from a Run's snapshot or a stream
+	// reset. It is skipped when the request filters vehicles, through
+	// ExtractOptions.Filter or a filter[...] parameter in the API URL, since
+	// the snapshot is then partial.
+	Absent bool
+	// MaxAge retires vehicles whose updated_at is older than this; 0 disables
+	MaxAge time.Duration
+	// Delete removes departed vehicles instead of marking them stale
+	Delete bool
+}
+
+// DefaultStalePolicy marks vehicles stale once a Run no longer sees them
+var DefaultStalePolicy = StalePolicy{Absent: true}
+
+// WithStalePolicy sets how Run and Stream retire vehicles that have left service
+func WithStalePolicy(policy StalePolicy) Option {
+	return func(p *ETLPipeline) {
+		p.stalePolicy = policy
+	}
+}
+
+// WithIncludeStale makes the vehicle queries return stale vehicles too
+// instead of only active ones
+func WithIncludeStale(include bool) Option {
+	return func(p *ETLPipeline) {
+		p.showStale = include
+	}
+}
+
+// activeVehicles is the vehicles table without stale vehicles
+const activeVehicles = "(SELECT * FROM vehicles WHERE stale = 0)"
+
+// vehiclesTable is what the queries read latest positions from
+func (p *ETLPipeline) vehiclesTable() string {
+	if p.showStale {
+		return "vehicles"
+	}
+	return activeVehicles
+}
+
+// retireVehicles applies the stale policy after runID, checking for absent
+// vehicles only if the run loaded a full snapshot, and returns how many
+// vehicles it retired
+func (p *ETLPipeline) retireVehicles(ctx context.Context, runID int64, snapshot bool) (int, error) {
+	policy := p.stalePolicy
+
+	var where string
+	var args []interface{}
+	if policy.Absent && snapshot && !p.partialSnapshot(false) {
+		where = "(last_seen_run IS NULL OR last_seen_run != ?)"
+		args = append(args, runID)
+	}
+	if policy.MaxAge > 0 {
+		if where != "" {
+			where += " OR "
+		}
+		where += "updated_at < ?"
+		args = append(args, p.clock.Now().Add(-policy.MaxAge).UTC())
+	}
+	if where == "" {
+		return 0, nil
+	}
+	return p.retire(ctx, where, args...)
+}
+
+// partialSnapshot reports whether a response holds only part of the fleet
+// because the effective request URL has a filter[...] parameter or, for a
+// stream, which does not follow next links, a page[limit]
+func (p *ETLPipeline) partialSnapshot(stream bool) bool {
+	requestURL, err := p.requestURL()
+	if err != nil {
+		return true
+	}
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return true
+	}
+	for key := range u.Query() {
+		if strings.HasPrefix(key, "filter[") || (stream && key == "page[limit]") {
+			return true
+		}
+	}
+	return false
+}
+
+// retireIDs retires the given vehicles, as a stream reset or remove event
+// does, and returns how many it retired
+func (p *ETLPipeline) retireIDs(ctx context.Context, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return p.retire(ctx, "id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+}
+
+// retire marks the vehicles matching where stale, or deletes them if the
+// policy says so
+func (p *ETLPipeline) retire(ctx context.Context, where string, args ...interface{}) (int, error) {
+	query := "UPDATE vehicles SET stale = 1 WHERE stale = 0 AND (" + where + ")"
+	if p.stalePolicy.Delete {
+		query = "DELETE FROM vehicles WHERE " + where
+	}
+	res, err := p.conn(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retire stale vehicles: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
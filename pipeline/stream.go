@@ -0,0 +1,299 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reconnect backoff bounds for Stream
+const (
+	streamMinBackoff = 1 * time.Second
+	streamMaxBackoff = 60 * time.Second
+)
+
+// streamEvent is a single server-sent event
+type streamEvent struct {
+	name string
+	data string
+}
+
+// Stream: Consume the MBTA vehicles event stream
+//
+// Events are applied to the database as they arrive: reset replaces the
+// current vehicle set, add/update upsert a single vehicle and remove retires
+// one under the StalePolicy (its position history is kept). A reset also
+// retires vehicles older than the policy's MaxAge. With a filter or page
+// limit, in ExtractOptions or the API URL, a reset does not retire the
+// vehicles it leaves out, as they may be outside the stream. Each
+// connection is recorded as a run in the ingestion ledger. Dropped
+// connections are retried with exponential backoff until ctx is cancelled.
+func (p *ETLPipeline) Stream(ctx context.Context) error {
+	if p.source != SourceJSONAPI {
+		return fmt.Errorf("streaming is only supported for the %s source", SourceJSONAPI)
+	}
+	backoff := streamMinBackoff
+
+	for {
+		received, err := p.streamOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if received {
+			backoff = streamMinBackoff
+		}
+		if err != nil {
+			log.Printf("Stream disconnected: %v (reconnecting in %v)", err, backoff)
+		} else {
+			log.Printf("Stream closed by server (reconnecting in %v)", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.clock.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// streamOnce reads a single connection until it ends, reporting whether any
+// event was applied so the caller can reset its backoff
+func (p *ETLPipeline) streamOnce(ctx context.Context) (received bool, err error) {
+	streamURL, err := p.requestURL()
+	if err != nil {
+		return false, err
+	}
+
+	start := p.clock.Now()
+	runID, err := p.startRun(ctx, streamURL, start)
+	if err != nil {
+		return false, err
+	}
+	result := RunResult{RunID: runID}
+	var status int
+	defer func() {
+		result.Duration = p.clock.Now().Sub(start)
+		runErr := err
+		if ctx.Err() != nil {
+			// Stopping the stream is how it ends, not a failure
+			runErr = nil
+		}
+		if ledgerErr := p.finishRun(ctx, result, status, runErr); ledgerErr != nil {
+			err = errors.Join(err, ledgerErr)
+		}
+	}()
+
+	req, err := p.newRequest(ctx, streamURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream is long-lived, so the per-request timeout must not apply
+	client := *p.client
+	client.Timeout = 0
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer resp.Body.Close()
+
+	status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("API returned status %d", resp.StatusCode)
+	}
+	log.Println("Connected to MBTA event stream")
+
+	err = readEvents(resp.Body, func(ev streamEvent) error {
+		if err := p.applyEvent(ctx, ev, &result); err != nil {
+			return fmt.Errorf("failed to apply %s event: %w", ev.name, err)
+		}
+		received = true
+		return nil
+	})
+	return received, err
+}
+
+// readEvents parses a text/event-stream body, calling fn for every event
+func readEvents(r io.Reader, fn func(streamEvent) error) error {
+	reader := bufio.NewReader(r)
+	var ev streamEvent
+	var data []string
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// An unterminated trailing event is incomplete and discarded
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// Blank line dispatches the pending event
+			if len(data) > 0 {
+				ev.data = strings.Join(data, "\n")
+				if err := fn(ev); err != nil {
+					return err
+				}
+			}
+			ev, data = streamEvent{}, nil
+		case strings.HasPrefix(line, ":"):
+			// Comment / keep-alive
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				ev.name = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}
+}
+
+// applyEvent runs a single stream event through validation, Transform and
+// Load, adding to the counts of the connection's ledger run
+func (p *ETLPipeline) applyEvent(ctx context.Context, ev streamEvent, result *RunResult) error {
+	switch ev.name {
+	case "reset":
+		var elements []json.RawMessage
+		if err := json.Unmarshal([]byte(ev.data), &elements); err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		vehicles := make([]Vehicle, len(elements))
+		for i, raw := range elements {
+			v, err := decodeVehicle(raw)
+			if err != nil {
+				return err
+			}
+			vehicles[i] = v
+		}
+		records, err := p.applyVehicles(ctx, ev.name, vehicles, result)
+		if err != nil {
+			return err
+		}
+		// A filtered or paged stream only resets its own slice of the fleet
+		retired := 0
+		if p.stalePolicy.Absent && !p.partialSnapshot(true) {
+			if retired, err = p.retireAllExcept(ctx, records); err != nil {
+				return err
+			}
+		}
+		expired, err := p.retireVehicles(ctx, result.RunID, false)
+		if err != nil {
+			return err
+		}
+		retired += expired
+		result.Retired += retired
+		log.Printf("Stream reset with %d vehicles (%d retired)", len(records), retired)
+
+	case "add", "update":
+		vehicle, err := decodeVehicle(json.RawMessage(ev.data))
+		if err != nil {
+			return err
+		}
+		_, err = p.applyVehicles(ctx, ev.name, []Vehicle{vehicle}, result)
+		return err
+
+	case "remove":
+		var vehicle Vehicle
+		if err := json.Unmarshal([]byte(ev.data), &vehicle); err != nil {
+			return fmt.Errorf("failed to parse JSON: %w", err)
+		}
+		retired, err := p.retireIDs(ctx, []string{vehicle.ID})
+		result.Retired += retired
+		return err
+
+	default:
+		log.Printf("Ignoring unknown stream event %q", ev.name)
+	}
+
+	return nil
+}
+
+// applyVehicles validates, transforms and loads the vehicles of a stream
+// event as part of result's run, returning the loaded records
+func (p *ETLPipeline) applyVehicles(ctx context.Context, event string, vehicles []Vehicle, result *RunResult) ([]VehicleRecord, error) {
+	result.Extracted += len(vehicles)
+	valid, rejected, err := p.validate(ctx, result.RunID, vehicles)
+	if err != nil {
+		return nil, err
+	}
+	result.addRejected(rejected)
+	logRejected(event, rejected)
+
+	records, err := p.transformer.Transform(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].RunID = result.RunID
+	}
+	result.Transformed += len(records)
+	result.Skipped += len(valid) - len(records)
+	if err := p.load(ctx, records); err != nil {
+		return nil, err
+	}
+	result.Loaded += len(records)
+	return records, nil
+}
+
+// logRejected logs the vehicles of a stream event that failed validation
+func logRejected(event string, counts map[string]int) {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	if n > 0 {
+		log.Printf("Rejected %d vehicles from %s event failing validation (%s)", n, event, formatCounts(counts))
+	}
+}
+
+// retireAllExcept retires every active vehicle not present in records
+func (p *ETLPipeline) retireAllExcept(ctx context.Context, records []VehicleRecord) (int, error) {
+	keep := make(map[string]bool, len(records))
+	for _, r := range records {
+		keep[r.ID] = true
+	}
+
+	rows, err := p.db.QueryContext(ctx, "SELECT id FROM vehicles WHERE stale = 0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to query vehicles: %w", err)
+	}
+	defer rows.Close()
+
+	var stale []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		if !keep[id] {
+			stale = append(stale, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	return p.retireIDs(ctx, stale)
+}
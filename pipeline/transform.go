@@ -8,7 +8,7 @@ import (
 // Transform: Clean and normalize data
 func (p *ETLPipeline) Transform(vehicles []Vehicle) ([]VehicleRecord, error) {
 	records := make([]VehicleRecord, 0, len(vehicles))
-	now := time.Now()
+	now := p.clock.Now()
 
 	for _, v := range vehicles {
 		// Skip invalid records
@@ -23,17 +23,6 @@ func (p *ETLPipeline) Transform(vehicles []Vehicle) ([]VehicleRecord, error) {
 			updatedAt = now
 		}
 
-		// Handle nullable fields with defaults
-		speed := 0.0
-		if v.Attributes.Speed != nil {
-			speed = *v.Attributes.Speed
-		}
-
-		bearing := 0
-		if v.Attributes.Bearing != nil {
-			bearing = *v.Attributes.Bearing
-		}
-
 		// Normalize status fields
 		currentStatus := normalizeStatus(v.Attributes.CurrentStatus)
 		occupancyStatus := normalizeStatus(v.Attributes.OccupancyStatus)
@@ -43,11 +32,14 @@ func (p *ETLPipeline) Transform(vehicles []Vehicle) ([]VehicleRecord, error) {
 			Label:           v.Attributes.Label,
 			Latitude:        v.Attributes.Latitude,
 			Longitude:       v.Attributes.Longitude,
-			Speed:           speed,
+			Speed:           copyPtr(v.Attributes.Speed), // nil stays unknown
 			DirectionID:     v.Attributes.DirectionID,
 			CurrentStatus:   currentStatus,
 			OccupancyStatus: occupancyStatus,
-			Bearing:         bearing,
+			Bearing:         copyPtr(v.Attributes.Bearing),
+			RouteID:         v.Relationships.Route.ID(),
+			TripID:          v.Relationships.Trip.ID(),
+			StopID:          v.Relationships.Stop.ID(),
 			UpdatedAt:       updatedAt,
 			IngestedAt:      now,
 		}
@@ -58,10 +50,19 @@ func (p *ETLPipeline) Transform(vehicles []Vehicle) ([]VehicleRecord, error) {
 	return records, nil
 }
 
+// copyPtr copies a nullable field so records do not alias the vehicles
+func copyPtr[T any](v *T) *T {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
 // normalizeStatus ensures status fields are consistent
 func normalizeStatus(status string) string {
 	if status == "" {
 		return "UNKNOWN"
 	}
 	return status
-}
\ No newline at end of file
+}
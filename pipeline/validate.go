@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationRules are the data quality checks applied to extracted vehicles
+// before Transform. A vehicle failing any rule is quarantined in
+// rejected_records under the name of the first rule it failed:
+//
+//	timestamp  updated_at is not RFC 3339
+//	future     updated_at is more than MaxFutureSkew ahead of the clock
+//	stale      updated_at is more than MaxAge behind the clock
+//	area       the position is outside ServiceArea
+//	speed      speed is negative or above MaxSpeed
+//	bearing    bearing is outside 0-359
+//	direction  direction_id is not 0 or 1
+//
+// Missing speed and bearing pass; zero ServiceArea, MaxSpeed and MaxAge
+// disable their rules.
+type ValidationRules struct {
+	ServiceArea   *BoundingBox
+	MaxSpeed      float64 // meters per second, as the feeds report speed
+	MaxAge        time.Duration
+	MaxFutureSkew time.Duration
+}
+
+// DefaultValidationRules cover the MBTA service area, out to the commuter
+// rail and ferry terminals, with generous limits for live data
+var DefaultValidationRules = ValidationRules{
+	ServiceArea:   &BoundingBox{MinLon: -72.0, MinLat: 41.2, MaxLon: -69.8, MaxLat: 43.0},
+	MaxSpeed:      50,
+	MaxAge:        24 * time.Hour,
+	MaxFutureSkew: 5 * time.Minute,
+}
+
+// WithValidation checks extracted vehicles against rules in Run, Stream,
+// LoadFrom and Replay. Without it every vehicle goes straight to Transform.
+func WithValidation(rules ValidationRules) Option {
+	return func(p *ETLPipeline) {
+		p.validation = &rules
+	}
+}
+
+// Contains reports whether the point is inside the box, edges included
+func (b BoundingBox) Contains(lon, lat float64) bool {
+	return lon >= b.MinLon && lon <= b.MaxLon && lat >= b.MinLat && lat <= b.MaxLat
+}
+
+// Check returns the name of the first rule v fails and why, or "" if it
+// passes them all
+func (r ValidationRules) Check(v Vehicle, now time.Time) (rule, detail string) {
+	a := v.Attributes
+
+	updatedAt, err := time.Parse(time.RFC3339, a.UpdatedAt)
+	if err != nil {
+		return "timestamp", fmt.Sprintf("invalid updated_at %q", a.UpdatedAt)
+	}
+	if updatedAt.After(now.Add(r.MaxFutureSkew)) {
+		return "future", fmt.Sprintf("updated_at %s is %v ahead", a.UpdatedAt, updatedAt.Sub(now).Round(time.Second))
+	}
+	if r.MaxAge > 0 && updatedAt.Before(now.Add(-r.MaxAge)) {
+		return "stale", fmt.Sprintf("updated_at %s is %v old", a.UpdatedAt, now.Sub(updatedAt).Round(time.Second))
+	}
+
+	if r.ServiceArea != nil && !r.ServiceArea.Contains(a.Longitude, a.Latitude) {
+		return "area", fmt.Sprintf("position %f,%f is outside the service area", a.Latitude, a.Longitude)
+	}
+	if a.Speed != nil && (*a.Speed < 0 || (r.MaxSpeed > 0 && *a.Speed > r.MaxSpeed)) {
+		return "speed", fmt.Sprintf("speed %g is out of range", *a.Speed)
+	}
+	if a.Bearing != nil && (*a.Bearing < 0 || *a.Bearing > 359) {
+		return "bearing", fmt.Sprintf("bearing %d is outside 0-359", *a.Bearing)
+	}
+	if a.DirectionID != 0 && a.DirectionID != 1 {
+		return "direction", fmt.Sprintf("direction_id %d is not 0 or 1", a.DirectionID)
+	}
+
+	return "", ""
+}
+
+// rejection is a vehicle that failed validation
+type rejection struct {
+	vehicle Vehicle
+	rule    string
+	detail  string
+}
+
+// validate checks vehicles against the configured rules, quarantines the
+// ones that fail and returns the rest along with the number each rule
+// rejected
+func (p *ETLPipeline) validate(ctx context.Context, runID int64, vehicles []Vehicle) ([]Vehicle, map[string]int, error) {
+	if p.validation == nil {
+		return vehicles, nil, nil
+	}
+
+	now := p.clock.Now()
+	valid := make([]Vehicle, 0, len(vehicles))
+	var rejected []rejection
+	for _, v := range vehicles {
+		if rule, detail := p.validation.Check(v, now); rule != "" {
+			rejected = append(rejected, rejection{v, rule, detail})
+			continue
+		}
+		valid = append(valid, v)
+	}
+	if len(rejected) == 0 {
+		return valid, nil, nil
+	}
+
+	if err := p.quarantine(ctx, runID, now, rejected); err != nil {
+		return nil, nil, err
+	}
+	counts := make(map[string]int)
+	for _, r := range rejected {
+		counts[r.rule]++
+	}
+	return valid, counts, nil
+}
+
+// quarantine stores rejected vehicles in rejected_records. The raw column
+// holds the JSON the feed sent for the vehicle; GTFS-RT vehicles, which have
+// none, are re-encoded as JSON:API.
+func (p *ETLPipeline) quarantine(ctx context.Context, runID int64, now time.Time, rejected []rejection) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		return quarantineRejections(ctx, tx, runID, now, rejected)
+	})
+}
+
+// quarantineRejections writes rejected vehicles to rejected_records in tx
+func quarantineRejections(ctx context.Context, tx *sql.Tx, runID int64, now time.Time, rejected []rejection) error {
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO rejected_records (run_id, vehicle_id, rule, detail, raw, rejected_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range rejected {
+		raw := r.vehicle.Raw
+		if raw == nil {
+			if raw, err = json.Marshal(r.vehicle); err != nil {
+				return fmt.Errorf("failed to encode vehicle %s: %w", r.vehicle.ID, err)
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, nullInt(runID), r.vehicle.ID, r.rule, r.detail, string(raw), now.UTC()); err != nil {
+			return fmt.Errorf("failed to quarantine vehicle %s: %w", r.vehicle.ID, err)
+		}
+	}
+	return nil
+}
+
+// addRejected adds per-rule rejection counts to the run result
+func (r *RunResult) addRejected(counts map[string]int) {
+	for rule, n := range counts {
+		if r.RejectedByRule == nil {
+			r.RejectedByRule = make(map[string]int)
+		}
+		r.RejectedByRule[rule] += n
+		r.Rejected += n
+	}
+}
+
+// formatCounts renders rule counts as "area=2, speed=1"
+func formatCounts(counts map[string]int) string {
+	rules := make([]string, 0, len(counts))
+	for rule := range counts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = fmt.Sprintf("%s=%d", rule, counts[rule])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,63 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Watch runs the pipeline every interval until ctx is cancelled.
+//
+// Cycles never overlap: if a cycle takes longer than the interval the next one
+// starts as soon as it finishes. Cancelling ctx aborts a cycle's requests and
+// retry or rate limit waits and rolls the cycle back, but a cycle whose data
+// is all loaded is always allowed to commit.
+func (p *ETLPipeline) Watch(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("watch interval must be positive, got %v", interval)
+	}
+
+	for cycle := 1; ; cycle++ {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		start := p.clock.Now()
+		result, err := p.RunContext(context.WithValue(ctx, uninterruptedKey{}, true))
+		if err != nil {
+			log.Printf("Cycle %d failed after %v: %v", cycle, p.clock.Now().Sub(start), err)
+		} else if result.NotModified {
+			log.Printf("Cycle %d: no change in %v", cycle, result.Duration)
+		} else {
+			log.Printf("Cycle %d: extracted %d, transformed %d, loaded %d in %v",
+				cycle, result.Extracted, result.Transformed, result.Loaded, result.Duration)
+		}
+
+		// Schedule the next cycle relative to this one's start
+		wait := interval - p.clock.Now().Sub(start)
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Watch stopped after %d cycles", cycle)
+			return nil
+		case <-p.clock.After(wait):
+		}
+	}
+}
+
+// uninterruptedKey marks a context whose database writes should complete even
+// if it is cancelled
+type uninterruptedKey struct{}
+
+// writeContext returns the context to write to the database with: ctx itself,
+// or ctx without its cancellation for a Watch cycle
+func writeContext(ctx context.Context) context.Context {
+	if ctx.Value(uninterruptedKey{}) != nil {
+		return context.WithoutCancel(ctx)
+	}
+	return ctx
+}